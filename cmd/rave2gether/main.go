@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/Nerdbergev/rave2gether/pkg/api"
@@ -27,7 +32,10 @@ func main() {
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
-	r.Use(middleware.Timeout(60 * time.Second))
+	// The event stream stays open for as long as the client listens
+	r.Use(middleware.Maybe(middleware.Timeout(60*time.Second), func(r *http.Request) bool {
+		return r.URL.Path != "/api/events"
+	}))
 
 	r.Use(cors.Handler(cors.Options{
 		// AllowedOrigins:   []string{"https://foo.com"}, // Use this to allow specific origin hosts
@@ -42,13 +50,37 @@ func main() {
 
 	api.GetAPIRouter(c, r)
 
-	go api.PrepareQueue()
-
-	go api.DownloadQueue()
+	api.StartWorkers()
 
-	go api.WorkQueue()
+	// Cancelled on shutdown so open event streams are closed
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Addr:        ":" + strconv.Itoa(c.Port),
+		Handler:     r,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	srv.RegisterOnShutdown(cancelBase)
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			log.Println("Error shutting down server:", err)
+		}
+		api.StopWorkers()
+		close(done)
+	}()
 
 	log.Println("Listening on port", c.Port)
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(c.Port), r))
+	err = srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 
 }
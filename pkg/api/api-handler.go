@@ -12,7 +12,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Nerdbergev/rave2gether/pkg/cache"
 	"github.com/Nerdbergev/rave2gether/pkg/config"
+	"github.com/Nerdbergev/rave2gether/pkg/downloader"
 	"github.com/Nerdbergev/rave2gether/pkg/queue"
 	"github.com/Nerdbergev/rave2gether/pkg/user"
 	"github.com/go-chi/chi/v5"
@@ -30,6 +32,14 @@ func apierror(w http.ResponseWriter, r *http.Request, err string, httpcode int)
 	http.Error(w, string(j), httpcode)
 }
 
+// admissionStatus is the HTTP status for a song that could not be queued.
+func admissionStatus(err error) int {
+	if queue.IsRejected(err) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
 func loginUnsucessfull(w http.ResponseWriter, r *http.Request) {
 	apierror(w, r, "Login unsucessfull", http.StatusUnauthorized)
 }
@@ -53,11 +63,37 @@ func addtoQueueHandler(w http.ResponseWriter, r *http.Request) {
 		username = "Fick Hans"
 	}
 	u := user.User{Username: username}
+	if req.Start < 0 || req.End < 0 || (req.End > 0 && req.End <= req.Start) {
+		refund(username)
+		apierror(w, r, "Invalid clip, end must be after start", http.StatusBadRequest)
+		return
+	}
+	start := time.Duration(req.Start * float64(time.Second))
+	end := time.Duration(req.End * float64(time.Second))
+	for _, id := range req.Tracks {
+		if _, ok := musiclib.Get(id); !ok {
+			refund(username)
+			apierror(w, r, "Track not found: "+id, http.StatusNotFound)
+			return
+		}
+	}
+	for i, id := range req.Tracks {
+		t, _ := musiclib.Get(id)
+		err = playlist.AddTrack(t, u)
+		if err != nil {
+			// Nothing was queued yet, so the coins are given back
+			if i == 0 {
+				refund(username)
+			}
+			apierror(w, r, "Error adding track: "+err.Error(), admissionStatus(err))
+			return
+		}
+	}
 	for _, q := range req.Queries {
 		if q == "" {
 			continue
 		}
-		err = preparelist.AddEntry(q, u)
+		err = preparelist.AddEntry(q, start, end, u)
 		if err != nil {
 			apierror(w, r, "Error adding song to queue: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -66,15 +102,14 @@ func addtoQueueHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func listQueueItems(q *queue.Queue) []queue.Entry {
+func listQueueItems(q *queue.Queue, current ...queue.Entry) []queue.Entry {
 	ee := []queue.Entry{}
-	downloadlist.SongInfo.Mutex.Lock()
-	e := downloadlist.SongInfo.Entry
-	downloadlist.SongInfo.Mutex.Unlock()
-	if e.ID != "" {
-		ee = append(ee, e)
+	for _, e := range current {
+		if e.ID != "" {
+			ee = append(ee, e)
+		}
 	}
-	ee = append(ee, q.Entries...)
+	ee = append(ee, q.GetAllEntries()...)
 	return ee
 }
 
@@ -89,7 +124,7 @@ func listQueueHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func listDownloadQueueHandler(w http.ResponseWriter, r *http.Request) {
-	ee := listQueueItems(&downloadlist.Queue)
+	ee := listQueueItems(&downloadlist.Queue, downloadlist.GetActiveEntries()...)
 	j, err := json.MarshalIndent(ee, "", "    ")
 	if err != nil {
 		apierror(w, r, "Error marshalling queue: "+err.Error(), http.StatusInternalServerError)
@@ -99,7 +134,7 @@ func listDownloadQueueHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func listPrepareQueueHandler(w http.ResponseWriter, r *http.Request) {
-	ee := listQueueItems(&preparelist.Queue)
+	ee := listQueueItems(&preparelist.Queue, preparelist.CurrentEntry())
 	j, err := json.MarshalIndent(ee, "", "    ")
 	if err != nil {
 		apierror(w, r, "Error marshalling queue: "+err.Error(), http.StatusInternalServerError)
@@ -110,8 +145,8 @@ func listPrepareQueueHandler(w http.ResponseWriter, r *http.Request) {
 
 func listAllQueuesHandler(w http.ResponseWriter, r *http.Request) {
 	var apr allQueuesResponse
-	apr.PrepareQueue = listQueueItems(&preparelist.Queue)
-	apr.DownloadQueue = listQueueItems(&downloadlist.Queue)
+	apr.PrepareQueue = listQueueItems(&preparelist.Queue, preparelist.CurrentEntry())
+	apr.DownloadQueue = listQueueItems(&downloadlist.Queue, downloadlist.GetActiveEntries()...)
 	apr.PlayQueue = listQueueItems(&playlist.Queue)
 	j, err := json.MarshalIndent(apr, "", "    ")
 	if err != nil {
@@ -123,7 +158,7 @@ func listAllQueuesHandler(w http.ResponseWriter, r *http.Request) {
 
 func getCurrentSongHandler(w http.ResponseWriter, r *http.Request) {
 	playlist.SongInfo.Mutex.Lock()
-	info := currentSongResponse{playlist.SongInfo.Name, playlist.SongInfo.Position, playlist.SongInfo.Length, playlist.SongInfo.AddedBy, playlist.SongInfo.AddedAt, playlist.SongInfo.Points}
+	info := currentSongResponse{playlist.SongInfo.Name, playlist.SongInfo.Artist, playlist.SongInfo.Thumbnail, playlist.SongInfo.Position, playlist.SongInfo.Length, playlist.SongInfo.AddedBy, playlist.SongInfo.AddedAt, playlist.SongInfo.Points, playlist.SongInfo.Paused}
 	playlist.SongInfo.Mutex.Unlock()
 	j, err := json.MarshalIndent(info, "", "    ")
 	if err != nil {
@@ -171,6 +206,8 @@ func deleteSongHandler(w http.ResponseWriter, r *http.Request) {
 		apierror(w, r, "Error deleting song: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// A song that is still pending does not need to be downloaded anymore
+	downloadlist.Cancel(songid)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -183,6 +220,44 @@ func getHistoryHandler(w http.ResponseWriter, r *http.Request, location string)
 	w.Write(history)
 }
 
+// eventsHandler streams queue events to the client as server-sent events
+// until the client disconnects.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apierror(w, r, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events := queue.Events.Subscribe()
+	defer queue.Events.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev := <-events:
+			j, err := json.Marshal(ev)
+			if err != nil {
+				log.Println("Error marshalling event:", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, j)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
 func skipSongHandler(w http.ResponseWriter, r *http.Request) {
 	_, claims, _ := jwtauth.FromContext(r.Context())
 	username, _ := claims["username"].(string)
@@ -191,6 +266,75 @@ func skipSongHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func pauseSongHandler(w http.ResponseWriter, r *http.Request) {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	username, _ := claims["username"].(string)
+	log.Println("User", username, "paused song")
+	err := playlist.Pause()
+	if err != nil {
+		apierror(w, r, "Error pausing song: "+err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func resumeSongHandler(w http.ResponseWriter, r *http.Request) {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	username, _ := claims["username"].(string)
+	log.Println("User", username, "resumed song")
+	err := playlist.Resume()
+	if err != nil {
+		apierror(w, r, "Error resuming song: "+err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func seekSongHandler(w http.ResponseWriter, r *http.Request) {
+	var req seekRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		apierror(w, r, "Error decoding request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	username, _ := claims["username"].(string)
+	position := time.Duration(req.Position * float64(time.Second))
+	log.Println("User", username, "seeked song to", position)
+	err = playlist.Seek(position)
+	if err != nil {
+		apierror(w, r, "Error seeking song: "+err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func getVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	j, err := json.MarshalIndent(volumeMessage{playlist.Volume()}, "", "    ")
+	if err != nil {
+		apierror(w, r, "Error marshalling volume: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(j)
+}
+
+func setVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	var req volumeMessage
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		apierror(w, r, "Error decoding request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = playlist.SetVolume(req.Volume)
+	if err != nil {
+		apierror(w, r, "Error setting volume: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func getTokens(username string) (string, string, error) {
 	claims := map[string]interface{}{"username": username, "refresh": false}
 	jwtauth.SetExpiryIn(claims, time.Hour)
@@ -510,3 +654,227 @@ func apiRegisterHandler(w http.ResponseWriter, r *http.Request, userAutoActive b
 	}
 	w.Write(j)
 }
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		apierror(w, r, "No query provided", http.StatusBadRequest)
+		return
+	}
+	n := defaultSearchResults
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSearchResults {
+			apierror(w, r, "n must be between 1 and "+strconv.Itoa(maxSearchResults), http.StatusBadRequest)
+			return
+		}
+	}
+	results, err := queue.Search(r.Context(), preparelist.Providers, query, n)
+	if err != nil && !queue.IsPermanent(err) {
+		apierror(w, r, "Error searching: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if results == nil {
+		results = []queue.SearchResult{}
+	}
+	j, err := json.MarshalIndent(results, "", "    ")
+	if err != nil {
+		apierror(w, r, "Error marshalling results: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(j)
+}
+
+func listFailedQueueHandler(w http.ResponseWriter, r *http.Request) {
+	ee := failedlist.GetAllEntries()
+	j, err := json.MarshalIndent(ee, "", "    ")
+	if err != nil {
+		apierror(w, r, "Error marshalling queue: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(j)
+}
+
+// mayManageEntry reports whether the user of the request is allowed to retry
+// or dismiss an entry, which is its requester or a moderator.
+func mayManageEntry(r *http.Request, mode config.Operatingmode, addedBy string) bool {
+	if mode <= config.Voting {
+		return true
+	}
+	u, err := getUserFromToken(r)
+	if err != nil {
+		return false
+	}
+	return u.Username == addedBy || u.IsModerator()
+}
+
+func retryFailedSongHandler(w http.ResponseWriter, r *http.Request, mode config.Operatingmode) {
+	songid := chi.URLParam(r, "songid")
+	if songid == "" {
+		apierror(w, r, "No songid provided", http.StatusBadRequest)
+		return
+	}
+	fe, err := failedlist.GetEntry(songid)
+	if err != nil {
+		apierror(w, r, "Error retrying song: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	if !mayManageEntry(r, mode, fe.AddedBy) {
+		apierror(w, r, "Not allowed to retry this song", http.StatusForbidden)
+		return
+	}
+	// The song is queued for whoever added it, so they pay for it again
+	owner, refunded := fe.AddedBy, fe.Refunded
+	if refunded && !chargeCoins(owner, addCost) {
+		apierror(w, r, "Not enough Coins", http.StatusPaymentRequired)
+		return
+	}
+	fe, err = failedlist.Retry(songid)
+	if err != nil {
+		if refunded {
+			refund(owner)
+		}
+		apierror(w, r, "Error retrying song: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	requeueFailed(fe)
+	w.WriteHeader(http.StatusOK)
+}
+
+func dismissFailedSongHandler(w http.ResponseWriter, r *http.Request, mode config.Operatingmode) {
+	songid := chi.URLParam(r, "songid")
+	if songid == "" {
+		apierror(w, r, "No songid provided", http.StatusBadRequest)
+		return
+	}
+	fe, err := failedlist.GetEntry(songid)
+	if err != nil {
+		apierror(w, r, "Error dismissing song: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	if !mayManageEntry(r, mode, fe.AddedBy) {
+		apierror(w, r, "Not allowed to dismiss this song", http.StatusForbidden)
+		return
+	}
+	err = failedlist.Dismiss(songid)
+	if err != nil {
+		apierror(w, r, "Error dismissing song: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func listLibraryHandler(w http.ResponseWriter, r *http.Request) {
+	n := 0
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 1 {
+			apierror(w, r, "n must be at least 1", http.StatusBadRequest)
+			return
+		}
+	}
+	tracks := musiclib.Search(r.URL.Query().Get("q"), n)
+	j, err := json.MarshalIndent(tracks, "", "    ")
+	if err != nil {
+		apierror(w, r, "Error marshalling library: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(j)
+}
+
+func rescanLibraryHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := musiclib.Scan(r.Context())
+	if err != nil {
+		apierror(w, r, "Error scanning library: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	j, err := json.MarshalIndent(rescanResponse{Tracks: n}, "", "    ")
+	if err != nil {
+		apierror(w, r, "Error marshalling response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(j)
+}
+
+func uploadHandler(w http.ResponseWriter, r *http.Request, cfg config.UploadConfig, mode config.Operatingmode, location string) {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	username, _ := claims["username"].(string)
+	if username == "" {
+		username = "Fick Hans"
+	}
+	// The coins were already taken, give them back if the upload fails
+	failed := func(err string, httpcode int) {
+		refund(username)
+		apierror(w, r, err, httpcode)
+	}
+	// Without user accounts everybody is the same user, so there is no limit
+	if mode > config.Voting && cfg.MaxQueuedPerUser > 0 && playlist.CountUploads(username) >= cfg.MaxQueuedPerUser {
+		failed("Too many uploads in the queue, wait until they are played", http.StatusTooManyRequests)
+		return
+	}
+	maxSize := int64(cfg.MaxSize) << 20
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	// Keep at most 1 MB in memory, the rest of the file goes to a temp file
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		failed("Error reading upload, files may be at most "+strconv.Itoa(cfg.MaxSize)+" MB: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		failed("No file provided: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	hash, length, err := queue.StoreUpload(file, header.Filename, location)
+	if err != nil {
+		failed("Error storing upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		name = strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename))
+	}
+	if fp, ok := downloader.CachedFile(location, hash); ok {
+		err = filecache.Add(cache.Item{Hash: hash, Title: name, Duration: length}, fp)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	err = playlist.AddUpload(name, hash, length, user.User{Username: username})
+	if err != nil {
+		failed("Error adding upload: "+err.Error(), admissionStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func listCacheHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := filecache.Search(r.URL.Query().Get("q"))
+	if err != nil {
+		apierror(w, r, "Error reading cache: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	j, err := json.MarshalIndent(items, "", "    ")
+	if err != nil {
+		apierror(w, r, "Error marshalling cache: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(j)
+}
+
+func pinCacheHandler(w http.ResponseWriter, r *http.Request, pinned bool) {
+	hash := chi.URLParam(r, "hash")
+	if hash == "" {
+		apierror(w, r, "No hash provided", http.StatusBadRequest)
+		return
+	}
+	err := filecache.Pin(hash, pinned)
+	if err != nil {
+		apierror(w, r, "Error pinning song: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -15,6 +15,23 @@ type errorResponse struct {
 
 type addSongRequest struct {
 	Queries []string `json:"queries"`
+	Tracks  []string `json:"tracks"`
+	// Start and End in seconds cut a clip out of the queried songs
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+type rescanResponse struct {
+	Tracks int `json:"tracks"`
+}
+
+type seekRequest struct {
+	// Position in seconds from the start of the song
+	Position float64 `json:"position"`
+}
+
+type volumeMessage struct {
+	Volume int `json:"volume"`
 }
 
 type voteRequest struct {
@@ -22,12 +39,15 @@ type voteRequest struct {
 }
 
 type currentSongResponse struct {
-	Name     string        `json:"name"`
-	Position time.Duration `json:"position"`
-	Length   time.Duration `json:"length"`
-	AddedBy  string        `json:"addedby"`
-	AddedAt  time.Time     `json:"addedat"`
-	Points   int           `json:"points"`
+	Name      string        `json:"name"`
+	Artist    string        `json:"artist"`
+	Thumbnail string        `json:"thumbnail"`
+	Position  time.Duration `json:"position"`
+	Length    time.Duration `json:"length"`
+	AddedBy   string        `json:"addedby"`
+	AddedAt   time.Time     `json:"addedat"`
+	Points    int           `json:"points"`
+	Paused    bool          `json:"paused"`
 }
 
 type authResponse struct {
@@ -1,11 +1,18 @@
 package api
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/Nerdbergev/rave2gether/pkg/cache"
 	"github.com/Nerdbergev/rave2gether/pkg/config"
+	"github.com/Nerdbergev/rave2gether/pkg/downloader"
+	"github.com/Nerdbergev/rave2gether/pkg/library"
 	"github.com/Nerdbergev/rave2gether/pkg/queue"
 	"github.com/Nerdbergev/rave2gether/pkg/user"
 	"github.com/go-chi/chi/v5"
@@ -15,66 +22,241 @@ import (
 var playlist queue.PlayQueue
 var downloadlist queue.DownloadQueue
 var preparelist queue.PrepareQueue
+var failedlist queue.FailedQueue
+var musiclib library.Library
+var filecache cache.Cache
 var tokenAuth *jwtauth.JWTAuth
 var userdb user.UserDB
-var idleSleep = 500
+var stateFile string
 
-const maxSleep = 5000
+const defaultSearchResults = 5
+const maxSearchResults = 25
 
-func PrepareQueue() {
-	for {
-		if preparelist.GetEntryCount() == 0 {
-			time.Sleep(time.Millisecond * time.Duration(idleSleep))
-			if idleSleep < maxSleep {
-				idleSleep += 500
-			}
-			continue
+var downloadWorkers = 1
+var rescanInterval time.Duration
+var addCost = 0
+var stopWorkers context.CancelFunc
+var workers sync.WaitGroup
+
+func PrepareQueue(ctx context.Context) {
+	for preparelist.Wait(ctx) {
+		e, err := preparelist.PrepareNext(ctx)
+		if ctx.Err() != nil {
+			return
 		}
-		e, err := preparelist.PrepareNext()
 		if err != nil {
 			log.Printf("Error preparing Song: %v ID: %v Error: %v", e.Name, e.ID, err)
+			failPrepared(e, err)
 		} else {
-			downloadlist.Entries = append(downloadlist.Entries, e)
+			failedlist.Resolve(e.ID)
+			if e.Hash != "" {
+				admitPrepared(e)
+			}
 		}
-		idleSleep = 500
 	}
 }
 
-func DownloadQueue() {
-	for {
-		if downloadlist.GetEntryCount() == 0 {
-			time.Sleep(time.Millisecond * time.Duration(idleSleep))
-			if idleSleep < maxSleep {
-				idleSleep += 500
+func failPrepared(e queue.Entry, err error) {
+	failedlist.Add(e, queue.StagePrepare, err)
+	// Rejections are paid back, retrying them is charged again
+	if queue.IsRejected(err) && addCost > 0 {
+		refund(e.AddedBy)
+		failedlist.SetRefunded(e.ID)
+	}
+}
+
+// admitPrepared turns songs that are already queued into a vote for them and
+// rejects songs that were played too recently. The rest is downloaded.
+func admitPrepared(e queue.Entry) {
+	ok, err := playlist.Admit(e, queue.StagePrepare)
+	if err != nil {
+		log.Printf("Not queueing Song: %v ID: %v Error: %v", e.Name, e.ID, err)
+		failPrepared(e, err)
+		return
+	}
+	if ok {
+		download(e)
+	}
+}
+
+// download queues a song for download. It waits in the play queue meanwhile,
+// so it can be voted on and is downloaded in play order.
+func download(e queue.Entry) {
+	playlist.AddPending(e)
+	downloadlist.PushEntry(e)
+}
+
+func DownloadQueue(ctx context.Context) {
+	for downloadlist.Wait(ctx) {
+		e, err := downloadlist.DownloadNext(ctx)
+		// A finished download is ready even if the shutdown came meanwhile,
+		// it is not in the download queue anymore
+		if err == nil && e.Hash != "" {
+			failedlist.Resolve(e.ID)
+			if !playlist.MarkReady(e) {
+				log.Printf("Song %v ID: %v was deleted while downloading", e.Name, e.ID)
 			}
-			continue
 		}
-		e, err := downloadlist.DownloadNext()
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			log.Printf("Error downloading Song: %v ID: %v Error: %v", e.Name, e.ID, err)
-		} else {
-			if e.Hash != "" {
-				playlist.Entries = append(playlist.Entries, e)
-			}
+			playlist.DropPending(e.ID)
+			failedlist.Add(e, queue.StageDownload, err)
 		}
-		idleSleep = 500
 	}
 }
 
-func WorkQueue() {
-	for {
-		if playlist.GetEntryCount() == 0 {
-			time.Sleep(time.Millisecond * time.Duration(idleSleep))
-			if idleSleep < maxSleep {
-				idleSleep += 500
-			}
-			continue
+func WorkQueue(ctx context.Context) {
+	for playlist.Wait(ctx) {
+		err := playlist.PlayNext(ctx)
+		if ctx.Err() != nil {
+			return
 		}
-		err := playlist.PlayNext()
 		if err != nil {
 			log.Println("Error playing next:", err)
 		}
-		idleSleep = 500
+	}
+}
+
+// RetryQueue puts failed entries back into their stage once their backoff
+// has passed.
+func RetryQueue(ctx context.Context) {
+	for failedlist.WaitDue(ctx) {
+		for _, fe := range failedlist.PopDue(time.Now()) {
+			log.Printf("Retrying Song: %v ID: %v Attempt: %v", fe.Name, fe.ID, fe.Attempts+1)
+			requeueFailed(fe)
+		}
+	}
+}
+
+// CacheQueue makes room in the cache whenever a new song is ready to be
+// played.
+func CacheQueue(ctx context.Context) {
+	events := queue.Events.Subscribe()
+	defer queue.Events.Unsubscribe(events)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			if ev.Entry == nil || ev.Entry.Hash == "" {
+				continue
+			}
+			if ev.Stage == queue.StagePlay && (ev.Type == queue.EventStageChanged || ev.Type == queue.EventEntryAdded) {
+				_, err := filecache.Evict(queuedHashes())
+				if err != nil {
+					log.Println("Error evicting from cache:", err)
+				}
+			}
+		}
+	}
+}
+
+// queuedHashes returns the songs that are waiting to be downloaded or played
+// or are playing right now.
+func queuedHashes() map[string]bool {
+	hashes := make(map[string]bool)
+	ee := listQueueItems(&downloadlist.Queue, downloadlist.GetActiveEntries()...)
+	ee = append(ee, listQueueItems(&playlist.Queue, playlist.CurrentEntry())...)
+	for _, e := range ee {
+		hashes[e.Hash] = true
+	}
+	return hashes
+}
+
+func requeueFailed(fe queue.FailedEntry) {
+	switch fe.Stage {
+	case queue.StagePrepare:
+		preparelist.PushEntry(fe.Entry)
+	case queue.StageDownload:
+		download(fe.Entry)
+	}
+}
+
+// StartWorkers starts the prepare, download and play workers. They block
+// while their queue is empty and are woken up as soon as an entry is added.
+func StartWorkers() {
+	var ctx context.Context
+	ctx, stopWorkers = context.WithCancel(context.Background())
+	pipeline := []func(context.Context){PrepareQueue, WorkQueue, RetryQueue, CacheQueue, LibraryQueue}
+	for i := 0; i < downloadWorkers; i++ {
+		pipeline = append(pipeline, DownloadQueue)
+	}
+	for _, worker := range pipeline {
+		workers.Add(1)
+		go func(worker func(context.Context)) {
+			defer workers.Done()
+			worker(ctx)
+		}(worker)
+	}
+}
+
+// StopWorkers cancels all workers, waits for them to return and saves the
+// queues. Unfinished entries are put back into their queue.
+func StopWorkers() {
+	if stopWorkers == nil {
+		return
+	}
+	stopWorkers()
+	workers.Wait()
+	saveQueues()
+}
+
+// searchProviders returns the search providers in the order they are
+// configured.
+func searchProviders(cfg config.Config) []queue.SearchProvider {
+	providers := []queue.SearchProvider{}
+	for _, name := range cfg.SearchProviders {
+		switch name {
+		case "youtube":
+			providers = append(providers, queue.YouTubeProvider{APIKey: cfg.YTApiKey})
+		case "ytdlp":
+			providers = append(providers, queue.YTDLPProvider{})
+		case "history":
+			providers = append(providers, queue.HistoryProvider{MusicDir: cfg.FileDir})
+		case "library":
+			log.Fatalln(`Search provider "library" was renamed to "history", library tracks are queued by their id`)
+		default:
+			log.Fatalln("Unknown search provider:", name)
+		}
+	}
+	return providers
+}
+
+// LibraryQueue scans the library once and then every rescanInterval, if it
+// is set.
+func LibraryQueue(ctx context.Context) {
+	if len(musiclib.Dirs) == 0 {
+		return
+	}
+	scan := func() {
+		_, err := musiclib.Scan(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Println("Error scanning library:", err)
+		}
+	}
+	scan()
+	if rescanInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(rescanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			scan()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func saveQueues() {
+	err := queue.SaveState(stateFile, &preparelist, &downloadlist, &playlist, &failedlist)
+	if err != nil {
+		log.Println("Error saving queues:", err)
 	}
 }
 
@@ -123,6 +305,30 @@ func Authenticator(ja *jwtauth.JWTAuth, ur user.Userright) func(http.Handler) ht
 	}
 }
 
+// chargeCoins takes cost coins from a user, it returns false if the user
+// does not have enough.
+func chargeCoins(username string, cost int) bool {
+	u, err := userdb.GetUser(username)
+	if err != nil || u.Coins < cost {
+		return false
+	}
+	userdb.SetUserCoins(u.Username, u.Coins-cost)
+	return true
+}
+
+// refund gives back the coins paid for adding an entry in coins mode.
+func refund(username string) {
+	if addCost == 0 {
+		return
+	}
+	u, err := userdb.GetUser(username)
+	if err != nil {
+		log.Println("Error refunding coins:", err)
+		return
+	}
+	userdb.SetUserCoins(u.Username, u.Coins+addCost)
+}
+
 func PaymentMiddleware(ja *jwtauth.JWTAuth, tokenCost int) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -131,11 +337,10 @@ func PaymentMiddleware(ja *jwtauth.JWTAuth, tokenCost int) func(http.Handler) ht
 				tokenInvalid(w, r)
 				return
 			}
-			if u.Coins < tokenCost {
+			if !chargeCoins(u.Username, tokenCost) {
 				apierror(w, r, "Not enough Coins", http.StatusPaymentRequired)
 				return
 			}
-			userdb.SetUserCoins(u.Username, u.Coins-tokenCost)
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -144,7 +349,69 @@ func PaymentMiddleware(ja *jwtauth.JWTAuth, tokenCost int) func(http.Handler) ht
 func GetAPIRouter(cfg config.Config, r *chi.Mux) {
 	playlist.Queue.MusicDir = cfg.FileDir
 	downloadlist.Queue.MusicDir = cfg.FileDir
-	preparelist.APIKey = cfg.YTApiKey
+	preparelist.Stage = queue.StagePrepare
+	downloadlist.Stage = queue.StageDownload
+	playlist.Stage = queue.StagePlay
+	preparelist.Providers = searchProviders(cfg)
+	preparelist.PlaylistLimit = cfg.PlaylistLimit
+	preparelist.Policy = queue.Policy{
+		MinDuration:     time.Duration(cfg.PolicyConfig.MinDuration) * time.Second,
+		MaxDuration:     time.Duration(cfg.PolicyConfig.MaxDuration) * time.Second,
+		BlockedKeywords: cfg.PolicyConfig.BlockedKeywords,
+		BlockedChannels: cfg.PolicyConfig.BlockedChannels,
+	}
+	downloadWorkers = cfg.DownloadWorkers
+	downloadlist.AudioFormat = cfg.AudioFormat
+	if cfg.AudioFormat == "native" {
+		downloadlist.AudioFormat = downloader.NativeFormat
+	}
+
+	err := os.MkdirAll(cfg.FileDir, 0755)
+	if err != nil {
+		log.Fatalln("Error creating file dir:", err)
+	}
+	stateFile = filepath.Join(cfg.FileDir, queue.StateFile)
+	playlist.Crossfade = time.Duration(cfg.Crossfade) * time.Second
+	playlist.Cooldown = time.Duration(cfg.ReplayCooldown) * time.Minute
+	playlist.Normalize = cfg.Normalize
+	playlist.LoudnessTarget = cfg.LoudnessTarget
+	downloadlist.AnalyzeLoudness = cfg.Normalize
+	playlist.SetVolume(100)
+	failedlist.MaxAttempts = cfg.RetryConfig.MaxAttempts
+	failedlist.Backoff = time.Duration(cfg.RetryConfig.Backoff) * time.Second
+
+	err = queue.LoadState(stateFile, &preparelist, &downloadlist, &playlist, &failedlist)
+	if err != nil {
+		log.Fatalln("Error loading queues:", err)
+	}
+	musiclib.Dirs = cfg.LibraryConfig.Dirs
+	musiclib.IndexFile = cfg.LibraryConfig.IndexFile
+	if musiclib.IndexFile == "" {
+		musiclib.IndexFile = filepath.Join(cfg.FileDir, "library.json")
+	}
+	filecache.Dir = cfg.FileDir
+	filecache.MaxSize = int64(cfg.CacheConfig.MaxSize) << 20
+	err = filecache.Load()
+	if err != nil {
+		log.Fatalln("Error loading cache index:", err)
+	}
+	downloadlist.Cache = &filecache
+	playlist.Cache = &filecache
+	downloadlist.Positions = playlist.Positions
+	err = musiclib.Load()
+	if err != nil {
+		log.Fatalln("Error loading library:", err)
+	}
+	rescanInterval = time.Duration(cfg.LibraryConfig.RescanInterval) * time.Minute
+
+	preparelist.SetChangeHandler(saveQueues)
+	downloadlist.SetChangeHandler(saveQueues)
+	playlist.SetChangeHandler(saveQueues)
+	failedlist.SetChangeHandler(saveQueues)
+	err = queue.MigrateHashes(cfg.FileDir, &filecache, &downloadlist, &playlist, &failedlist)
+	if err != nil {
+		log.Fatalln("Error migrating cache:", err)
+	}
 
 	if cfg.Mode > config.Voting {
 		tokenAuth = jwtauth.New("HS256", []byte(cfg.Secret), nil)
@@ -161,6 +428,10 @@ func GetAPIRouter(cfg config.Config, r *chi.Mux) {
 		for _, u := range userdb.ListUsers() {
 			userdb.SetUserCoins(u.Username, cfg.CoinConfig.InitialCoins)
 		}
+		addCost = cfg.CoinConfig.PerAddCoins
+		preparelist.Charge = func(username string) bool {
+			return chargeCoins(username, cfg.CoinConfig.PerAddCoins)
+		}
 		ticker := time.NewTicker(time.Duration(cfg.CoinConfig.RegenTime) * time.Second)
 		go func() {
 			for range ticker.C {
@@ -177,6 +448,7 @@ func GetAPIRouter(cfg config.Config, r *chi.Mux) {
 		r.Get("/mode", func(w http.ResponseWriter, r *http.Request) {
 			apiModeHandler(w, r, cfg.Mode)
 		})
+		r.Get("/events", eventsHandler)
 		if cfg.Mode > config.Voting {
 			r.Post("/token", apiGetTokenHandler)
 			r.Post("/refreshtoken", apiRefreshTokenHandler)
@@ -190,6 +462,7 @@ func GetAPIRouter(cfg config.Config, r *chi.Mux) {
 			r.Get("/prepare", listPrepareQueueHandler)
 			r.Get("/all", listAllQueuesHandler)
 			r.Get("/current", getCurrentSongHandler)
+			r.Get("/failed", listFailedQueueHandler)
 			r.Group(func(r chi.Router) {
 				if cfg.Mode > config.Voting {
 					r.Use(jwtauth.Verifier(tokenAuth))
@@ -200,12 +473,26 @@ func GetAPIRouter(cfg config.Config, r *chi.Mux) {
 						r.Use(PaymentMiddleware(tokenAuth, cfg.CoinConfig.PerAddCoins))
 					}
 					r.Post("/", addtoQueueHandler)
+					r.Post("/upload", func(w http.ResponseWriter, r *http.Request) {
+						uploadHandler(w, r, cfg.UploadConfig, cfg.Mode, cfg.FileDir)
+					})
 				})
 				r.Group(func(r chi.Router) {
 					if cfg.Mode > config.Voting {
 						r.Use(Authenticator(tokenAuth, user.Moderator))
 					}
 					r.Post("/skip", skipSongHandler)
+					r.Post("/pause", pauseSongHandler)
+					r.Post("/resume", resumeSongHandler)
+					r.Post("/seek", seekSongHandler)
+				})
+				r.Route("/failed/{songid}", func(r chi.Router) {
+					r.Post("/retry", func(w http.ResponseWriter, r *http.Request) {
+						retryFailedSongHandler(w, r, cfg.Mode)
+					})
+					r.Delete("/", func(w http.ResponseWriter, r *http.Request) {
+						dismissFailedSongHandler(w, r, cfg.Mode)
+					})
 				})
 				r.Route("/{songid}", func(r chi.Router) {
 					if cfg.Mode > config.Simple {
@@ -226,6 +513,52 @@ func GetAPIRouter(cfg config.Config, r *chi.Mux) {
 
 			})
 		})
+		r.Route("/search", func(r chi.Router) {
+			if cfg.Mode > config.Voting {
+				r.Use(jwtauth.Verifier(tokenAuth))
+				r.Use(Authenticator(tokenAuth, user.Unprivileged))
+			}
+			r.Get("/", searchHandler)
+		})
+		r.Route("/library", func(r chi.Router) {
+			if cfg.Mode > config.Voting {
+				r.Use(jwtauth.Verifier(tokenAuth))
+				r.Use(Authenticator(tokenAuth, user.Unprivileged))
+			}
+			r.Get("/", listLibraryHandler)
+			r.Group(func(r chi.Router) {
+				if cfg.Mode > config.Voting {
+					r.Use(Authenticator(tokenAuth, user.Moderator))
+				}
+				r.Post("/rescan", rescanLibraryHandler)
+			})
+		})
+		r.Route("/cache", func(r chi.Router) {
+			if cfg.Mode > config.Voting {
+				r.Use(jwtauth.Verifier(tokenAuth))
+				r.Use(Authenticator(tokenAuth, user.Moderator))
+			}
+			r.Group(func(r chi.Router) {
+				if cfg.Mode > config.Voting {
+					r.Use(Authenticator(tokenAuth, user.Admin))
+				}
+				r.Get("/", listCacheHandler)
+			})
+			r.Post("/{hash}/pin", func(w http.ResponseWriter, r *http.Request) {
+				pinCacheHandler(w, r, true)
+			})
+			r.Delete("/{hash}/pin", func(w http.ResponseWriter, r *http.Request) {
+				pinCacheHandler(w, r, false)
+			})
+		})
+		r.Route("/player", func(r chi.Router) {
+			if cfg.Mode > config.Voting {
+				r.Use(jwtauth.Verifier(tokenAuth))
+				r.Use(Authenticator(tokenAuth, user.Moderator))
+			}
+			r.Get("/volume", getVolumeHandler)
+			r.Put("/volume", setVolumeHandler)
+		})
 		if cfg.Mode > config.Voting {
 			r.Route("/self", func(r chi.Router) {
 				r.Use(jwtauth.Verifier(tokenAuth))
@@ -0,0 +1,361 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nerdbergev/rave2gether/pkg/downloader"
+)
+
+const IndexFile = "cache.json"
+
+// minAge protects files that were just downloaded, they may be on their way
+// into the play queue.
+const minAge = time.Minute
+
+// Item is a song in the cache. Songs that were in the cache dir before it
+// had an index only have the fields that can be read from the file.
+type Item struct {
+	Hash         string        `json:"hash"`
+	Title        string        `json:"title"`
+	URL          string        `json:"url"`
+	Duration     time.Duration `json:"duration"`
+	Size         int64         `json:"size"`
+	DownloadedAt time.Time     `json:"downloadedat"`
+	LastPlayed   time.Time     `json:"lastplayed"`
+	PlayCount    int           `json:"playcount"`
+	Pinned       bool          `json:"pinned"`
+	// Loudness is the measured loudness in LUFS, 0 if it was not measured
+	Loudness float64 `json:"loudness,omitempty"`
+	path     string
+}
+
+// lastUsed is when the file was last played, or downloaded if it never was.
+func (i Item) lastUsed() time.Time {
+	if i.LastPlayed.After(i.DownloadedAt) {
+		return i.LastPlayed
+	}
+	return i.DownloadedAt
+}
+
+// Cache is the index of the downloaded songs in Dir. It keeps them below
+// MaxSize bytes by deleting the least recently used ones.
+type Cache struct {
+	Dir     string
+	MaxSize int64
+	mutex   sync.Mutex
+	items   map[string]*Item
+}
+
+func (c *Cache) indexPath() string {
+	return filepath.Join(c.Dir, IndexFile)
+}
+
+// Load reads the index and brings it up to date with the files in Dir.
+func (c *Cache) Load() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.items = make(map[string]*Item)
+	b, err := os.ReadFile(c.indexPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.New("Error reading cache index: " + err.Error())
+	}
+	if err == nil {
+		var items []*Item
+		err = json.Unmarshal(b, &items)
+		if err != nil {
+			return errors.New("Error decoding cache index: " + err.Error())
+		}
+		for _, i := range items {
+			c.items[i.Hash] = i
+		}
+	}
+	err = c.scan()
+	if err != nil {
+		return err
+	}
+	return c.save()
+}
+
+// save writes the index, the caller must hold mutex.
+func (c *Cache) save() error {
+	items := make([]*Item, 0, len(c.items))
+	for _, i := range c.items {
+		items = append(items, i)
+	}
+	sort.Slice(items, func(a, b int) bool {
+		return items[a].Hash < items[b].Hash
+	})
+	b, err := json.MarshalIndent(items, "", "    ")
+	if err != nil {
+		return errors.New("Error encoding cache index: " + err.Error())
+	}
+	tmp := c.indexPath() + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return errors.New("Error writing cache index: " + err.Error())
+	}
+	err = os.Rename(tmp, c.indexPath())
+	if err != nil {
+		return errors.New("Error writing cache index: " + err.Error())
+	}
+	return nil
+}
+
+// scan updates the sizes from the files in Dir and forgets files that are
+// gone, the caller must hold mutex.
+func (c *Cache) scan() error {
+	files, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return errors.New("Error reading cache dir: " + err.Error())
+	}
+	found := make(map[string]bool)
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		// Files starting with a dot are still being written
+		if f.IsDir() || !isAudio(ext) || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		hash := strings.TrimSuffix(f.Name(), ext)
+		i, ok := c.items[hash]
+		if !ok {
+			i = &Item{Hash: hash}
+			c.items[hash] = i
+		}
+		i.Size = info.Size()
+		i.path = filepath.Join(c.Dir, f.Name())
+		if i.DownloadedAt.IsZero() {
+			i.DownloadedAt = info.ModTime()
+		}
+		found[hash] = true
+	}
+	for hash := range c.items {
+		if !found[hash] {
+			delete(c.items, hash)
+		}
+	}
+	return nil
+}
+
+func isAudio(ext string) bool {
+	for _, e := range downloader.Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the path of a cached song.
+func (c *Cache) Lookup(hash string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	i, ok := c.items[hash]
+	if !ok {
+		return "", false
+	}
+	if _, err := os.Stat(i.path); err != nil {
+		log.Println("Cached song " + hash + " is gone: " + err.Error())
+		delete(c.items, hash)
+		err = c.save()
+		if err != nil {
+			log.Println(err)
+		}
+		return "", false
+	}
+	return i.path, true
+}
+
+// Add puts a song that was stored at path into the index.
+func (c *Cache) Add(item Item, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.New("Error adding song to cache: " + err.Error())
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if old, ok := c.items[item.Hash]; ok {
+		item.DownloadedAt = old.DownloadedAt
+		item.LastPlayed = old.LastPlayed
+		item.PlayCount = old.PlayCount
+		item.Pinned = old.Pinned
+		if item.Loudness == 0 {
+			item.Loudness = old.Loudness
+		}
+	}
+	item.Size = info.Size()
+	item.path = path
+	if item.DownloadedAt.IsZero() {
+		item.DownloadedAt = time.Now()
+	}
+	c.items[item.Hash] = &item
+	return c.save()
+}
+
+// Rename moves the index entry of a song whose file was renamed to path. If
+// the new hash is already in the index, the two are merged.
+func (c *Cache) Rename(old string, hash string, path string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	i, ok := c.items[old]
+	if !ok {
+		return nil
+	}
+	delete(c.items, old)
+	if n, ok := c.items[hash]; ok {
+		n.PlayCount += i.PlayCount
+		if i.LastPlayed.After(n.LastPlayed) {
+			n.LastPlayed = i.LastPlayed
+		}
+		n.Pinned = n.Pinned || i.Pinned
+		if n.Loudness == 0 {
+			n.Loudness = i.Loudness
+		}
+		return c.save()
+	}
+	i.Hash = hash
+	i.path = path
+	c.items[hash] = i
+	return c.save()
+}
+
+// Loudness returns the loudness measured for a song, 0 if it is unknown.
+func (c *Cache) Loudness(hash string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	i, ok := c.items[hash]
+	if !ok {
+		return 0
+	}
+	return i.Loudness
+}
+
+// SetLoudness stores the loudness measured for a song.
+func (c *Cache) SetLoudness(hash string, loudness float64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	i, ok := c.items[hash]
+	if !ok {
+		return nil
+	}
+	i.Loudness = loudness
+	return c.save()
+}
+
+// Played records that a song was played.
+func (c *Cache) Played(hash string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	i, ok := c.items[hash]
+	if !ok {
+		return
+	}
+	i.LastPlayed = time.Now()
+	i.PlayCount++
+	err := c.save()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Pin protects a song from being evicted, or removes the protection.
+func (c *Cache) Pin(hash string, pinned bool) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	err := c.scan()
+	if err != nil {
+		return err
+	}
+	i, ok := c.items[hash]
+	if !ok {
+		return errors.New("song not in cache")
+	}
+	i.Pinned = pinned
+	return c.save()
+}
+
+// Search returns the cached songs whose title, URL or hash contain all
+// words of the query, the most recently used first. An empty query matches
+// all songs.
+func (c *Cache) Search(query string) ([]Item, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	err := c.scan()
+	if err != nil {
+		return nil, err
+	}
+	words := strings.Fields(strings.ToLower(query))
+	items := make([]Item, 0, len(c.items))
+	for _, i := range c.items {
+		text := strings.ToLower(i.Title + " " + i.URL + " " + i.Hash)
+		match := true
+		for _, w := range words {
+			if !strings.Contains(text, w) {
+				match = false
+				break
+			}
+		}
+		if match {
+			items = append(items, *i)
+		}
+	}
+	sort.Slice(items, func(a, b int) bool {
+		return items[a].lastUsed().After(items[b].lastUsed())
+	})
+	return items, nil
+}
+
+// Evict deletes the least recently used songs until the cache is below
+// MaxSize. Pinned songs and the protected hashes, which are queued or
+// playing, are never deleted. It returns the number of bytes freed.
+func (c *Cache) Evict(protected map[string]bool) (int64, error) {
+	if c.MaxSize <= 0 {
+		return 0, nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	err := c.scan()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	candidates := []*Item{}
+	for _, i := range c.items {
+		size += i.Size
+		if !i.Pinned && !protected[i.Hash] && time.Since(i.DownloadedAt) > minAge {
+			candidates = append(candidates, i)
+		}
+	}
+	sort.Slice(candidates, func(a, b int) bool {
+		return candidates[a].lastUsed().Before(candidates[b].lastUsed())
+	})
+	var freed int64
+	for _, i := range candidates {
+		if size-freed <= c.MaxSize {
+			break
+		}
+		err := os.Remove(i.path)
+		if err != nil {
+			log.Println("Error evicting " + i.Hash + ": " + err.Error())
+			continue
+		}
+		log.Printf("Evicted %v from the cache, %v bytes", i.Hash, i.Size)
+		freed += i.Size
+		delete(c.items, i.Hash)
+	}
+	if size-freed > c.MaxSize {
+		log.Printf("Cache is %v bytes over its limit, everything else is queued or pinned", size-freed-c.MaxSize)
+	}
+	return freed, c.save()
+}
@@ -24,6 +24,33 @@ type CoinConfig struct {
 	RegenTime    int
 }
 
+type RetryConfig struct {
+	MaxAttempts int
+	Backoff     int
+}
+
+type PolicyConfig struct {
+	MinDuration     int
+	MaxDuration     int
+	BlockedKeywords []string
+	BlockedChannels []string
+}
+
+type CacheConfig struct {
+	MaxSize int
+}
+
+type UploadConfig struct {
+	MaxSize          int
+	MaxQueuedPerUser int
+}
+
+type LibraryConfig struct {
+	Dirs           []string
+	IndexFile      string
+	RescanInterval int
+}
+
 type UserConfig struct {
 	UserConfigDir          string
 	AllowUserRegistration  bool
@@ -31,21 +58,41 @@ type UserConfig struct {
 }
 
 type Config struct {
-	Port       int
-	FileDir    string
-	YTApiKey   string
-	Mode       Operatingmode
-	Secret     string
-	CoinConfig CoinConfig
-	UserConfig UserConfig
+	Port            int
+	FileDir         string
+	YTApiKey        string
+	SearchProviders []string
+	Mode            Operatingmode
+	Secret          string
+	DownloadWorkers int
+	AudioFormat     string
+	PlaylistLimit   int
+	Crossfade       int
+	ReplayCooldown  int
+	Normalize       bool
+	LoudnessTarget  float64
+	CoinConfig      CoinConfig
+	UserConfig      UserConfig
+	LibraryConfig   LibraryConfig
+	PolicyConfig    PolicyConfig
+	UploadConfig    UploadConfig
+	CacheConfig     CacheConfig
+	RetryConfig     RetryConfig
 }
 
 func LoadConfig(filepath string) (Config, error) {
 
 	res := Config{
-		Port:    8081,
-		FileDir: "/tmp/rave2gether/music",
-		Mode:    Simple,
+		Port:            8081,
+		FileDir:         "/tmp/rave2gether/music",
+		Mode:            Simple,
+		SearchProviders: []string{"youtube", "ytdlp"},
+		DownloadWorkers: 1,
+		AudioFormat:     "mp3",
+		PlaylistLimit:   50,
+		Normalize:       true,
+		ReplayCooldown:  30,
+		LoudnessTarget:  -14,
 		CoinConfig: CoinConfig{
 			InitialCoins: 10,
 			PerVoteCoins: 1,
@@ -58,6 +105,17 @@ func LoadConfig(filepath string) (Config, error) {
 			AllowUserRegistration:  true,
 			ActivateUsersByDefault: true,
 		},
+		CacheConfig: CacheConfig{
+			MaxSize: 4096,
+		},
+		UploadConfig: UploadConfig{
+			MaxSize:          50,
+			MaxQueuedPerUser: 3,
+		},
+		RetryConfig: RetryConfig{
+			MaxAttempts: 3,
+			Backoff:     30,
+		},
 	}
 	file, err := os.Open(filepath)
 	if err != nil {
@@ -72,6 +130,14 @@ func LoadConfig(filepath string) (Config, error) {
 	if res.Secret == "" {
 		return res, errors.New("secret is empty")
 	}
+	if res.DownloadWorkers < 1 {
+		return res, errors.New("download workers must be at least 1")
+	}
+	switch res.AudioFormat {
+	case "mp3", "flac", "vorbis", "wav", "native":
+	default:
+		return res, errors.New("audio format must be mp3, flac, vorbis, wav or native")
+	}
 	return res, nil
 }
 
@@ -1,27 +1,73 @@
 package downloader
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
 )
 
-func ytdlp(url string, path string) error {
+// Extensions are the audio files that can be played from the cache.
+var Extensions = []string{".mp3", ".flac", ".ogg", ".wav"}
+
+// NativeFormat keeps audio that is already in a playable format and converts
+// everything else to mp3.
+const NativeFormat = "flac>flac/ogg>vorbis/wav>wav/mp3"
+
+// section formats a clip for --download-sections, an end of 0 is the end of
+// the song.
+func section(start time.Duration, end time.Duration) string {
+	to := "inf"
+	if end > 0 {
+		to = fmt.Sprintf("%g", end.Seconds())
+	}
+	return fmt.Sprintf("*%g-%s", start.Seconds(), to)
+}
+
+// ytdlp runs the download and calls progress, if it is set, whenever yt-dlp
+// reports how far it is.
+func ytdlp(ctx context.Context, url string, path string, format string, start time.Duration, end time.Duration, progress func(Progress)) error {
 	log.Println("Downloading", url, "to", path)
-	cmd := exec.Command("yt-dlp")
+	cmd := exec.CommandContext(ctx, "yt-dlp")
 	cmd.Args = append(cmd.Args, "-x")
-	cmd.Args = append(cmd.Args, "--audio-format=mp3")
+	cmd.Args = append(cmd.Args, "--audio-format="+format)
+	cmd.Args = append(cmd.Args, "--no-playlist")
+	cmd.Args = append(cmd.Args, "--newline", "--progress", "--progress-template", progressTemplate)
+	if start > 0 || end > 0 {
+		cmd.Args = append(cmd.Args, "--download-sections", section(start, end))
+		cmd.Args = append(cmd.Args, "--force-keyframes-at-cuts")
+	}
 	cmd.Args = append(cmd.Args, url)
 	cmd.Args = append(cmd.Args, "-o"+path+"")
 	var out bytes.Buffer
 	var stderr bytes.Buffer
-	cmd.Stdout = &out
 	cmd.Stderr = &stderr
-	err := cmd.Run()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if p, ok := parseProgress(scanner.Text()); ok {
+			if progress != nil {
+				progress(p)
+			}
+			continue
+		}
+		out.WriteString(scanner.Text() + "\n")
+	}
+	err = cmd.Wait()
 	if err != nil {
 		fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
 		return err
@@ -31,17 +77,30 @@ func ytdlp(url string, path string) error {
 	return nil
 }
 
-func Download(url string, hash string, location string) error {
-	path := filepath.Join(location, hash) + ".mp3"
-	if _, err := os.Stat(path); err == nil {
-		return nil
-	} else if errors.Is(err, os.ErrNotExist) {
-		err := ytdlp(url, path)
-		if err != nil {
-			return errors.New("Error downloading: " + err.Error())
+// CachedFile returns the path of the downloaded file for hash, whatever
+// audio format it was saved in.
+func CachedFile(location string, hash string) (string, bool) {
+	for _, ext := range Extensions {
+		path := filepath.Join(location, hash) + ext
+		if _, err := os.Stat(path); err == nil {
+			return path, true
 		}
-		return nil
-	} else {
-		return errors.New("Error checking file: " + err.Error())
 	}
+	return "", false
+}
+
+// Download extracts the audio of url in the given yt-dlp audio format and
+// returns the path of the file. If start or end are set, only that part of
+// the song is downloaded. progress may be nil. It always runs yt-dlp, the
+// cache index decides whether a song needs to be downloaded.
+func Download(ctx context.Context, url string, hash string, location string, format string, start time.Duration, end time.Duration, progress func(Progress)) (string, error) {
+	err := ytdlp(ctx, url, filepath.Join(location, hash)+".%(ext)s", format, start, end, progress)
+	if err != nil {
+		return "", errors.New("Error downloading: " + err.Error())
+	}
+	path, ok := CachedFile(location, hash)
+	if !ok {
+		return "", errors.New("downloaded file is not in a playable format")
+	}
+	return path, nil
 }
@@ -0,0 +1,70 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"time"
+)
+
+type PlaylistEntry struct {
+	URL   string `json:"url"`
+	Title string `json:"title"`
+}
+
+// Info is what yt-dlp knows about a URL without downloading it.
+type Info struct {
+	Type      string          `json:"_type"`
+	ID        string          `json:"id"`
+	Extractor string          `json:"extractor"`
+	Title     string          `json:"title"`
+	Duration  float64         `json:"duration"`
+	Artist    string          `json:"artist"`
+	Uploader  string          `json:"uploader"`
+	Channel   string          `json:"channel"`
+	Thumbnail string          `json:"thumbnail"`
+	Entries   []PlaylistEntry `json:"entries"`
+}
+
+func (i Info) IsPlaylist() bool {
+	return i.Type == "playlist"
+}
+
+func (i Info) Length() time.Duration {
+	return time.Duration(i.Duration * float64(time.Second))
+}
+
+// ArtistName returns the artist if the site knows it, otherwise who uploaded
+// the track.
+func (i Info) ArtistName() string {
+	if i.Artist != "" {
+		return i.Artist
+	}
+	if i.Channel != "" {
+		return i.Channel
+	}
+	return i.Uploader
+}
+
+// FetchInfo asks yt-dlp about a URL. Playlists are not resolved any further
+// than the URLs of their entries. A video URL that also names a playlist is
+// treated as the video.
+func FetchInfo(ctx context.Context, url string) (Info, error) {
+	cmd := exec.CommandContext(ctx, "yt-dlp", "--dump-single-json", "--flat-playlist", "--no-playlist", url)
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return Info{}, errors.New("Error running yt-dlp: " + err.Error() + ": " + stderr.String())
+	}
+	var info Info
+	err = json.Unmarshal(out.Bytes(), &info)
+	if err != nil {
+		return Info{}, errors.New("Error decoding yt-dlp output: " + err.Error())
+	}
+	return info, nil
+}
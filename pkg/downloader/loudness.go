@@ -0,0 +1,34 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+var integratedLoudness = regexp.MustCompile(`I:\s+(-?[0-9.]+) LUFS`)
+
+// Loudness measures the integrated loudness of a file in LUFS according to
+// EBU R128 with the ebur128 filter of ffmpeg.
+func Loudness(ctx context.Context, path string) (float64, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-nostats", "-i", path, "-filter_complex", "ebur128", "-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return 0, errors.New("Error running ffmpeg: " + err.Error())
+	}
+	// The summary at the end holds the loudness of the whole file
+	matches := integratedLoudness.FindAllStringSubmatch(stderr.String(), -1)
+	if len(matches) == 0 {
+		return 0, errors.New("no loudness found in ffmpeg output")
+	}
+	loudness, err := strconv.ParseFloat(matches[len(matches)-1][1], 64)
+	if err != nil {
+		return 0, errors.New("Error parsing loudness: " + err.Error())
+	}
+	return loudness, nil
+}
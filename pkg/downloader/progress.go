@@ -0,0 +1,54 @@
+package downloader
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const progressPrefix = "[rave2gether]"
+
+// progressTemplate makes yt-dlp print every progress update as one line of
+// plain numbers, NA is printed for the ones it does not know.
+const progressTemplate = "download:" + progressPrefix + " %(progress.downloaded_bytes)s %(progress.total_bytes)s %(progress.total_bytes_estimate)s %(progress.speed)s %(progress.eta)s"
+
+// Progress is how far a download is. Speed is in bytes per second, it and
+// ETA are 0 while yt-dlp does not know them.
+type Progress struct {
+	Percent float64       `json:"percent"`
+	Speed   float64       `json:"speed"`
+	ETA     time.Duration `json:"eta"`
+}
+
+func parseNumber(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
+
+// parseProgress reads a line printed with progressTemplate.
+func parseProgress(line string) (Progress, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), progressPrefix)
+	if !ok {
+		return Progress{}, false
+	}
+	fields := strings.Fields(rest)
+	if len(fields) != 5 {
+		return Progress{}, false
+	}
+	var p Progress
+	downloaded, _ := parseNumber(fields[0])
+	total, ok := parseNumber(fields[1])
+	if !ok {
+		total, _ = parseNumber(fields[2])
+	}
+	if total > 0 {
+		p.Percent = min(downloaded/total*100, 100)
+	}
+	p.Speed, _ = parseNumber(fields[3])
+	eta, _ := parseNumber(fields[4])
+	p.ETA = time.Duration(eta * float64(time.Second))
+	return p, true
+}
@@ -0,0 +1,241 @@
+package library
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhowden/tag"
+)
+
+// Extensions are the file types that are indexed.
+var Extensions = []string{".mp3", ".flac", ".ogg", ".oga", ".wav"}
+
+type Track struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Title   string    `json:"title"`
+	Artist  string    `json:"artist"`
+	Album   string    `json:"album"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// Name is how the track is shown in the queue.
+func (t Track) Name() string {
+	if t.Title == "" {
+		return strings.TrimSuffix(filepath.Base(t.Path), filepath.Ext(t.Path))
+	}
+	if t.Artist == "" {
+		return t.Title
+	}
+	return t.Artist + " - " + t.Title
+}
+
+// Library is an index of the music files in a set of directories.
+type Library struct {
+	Dirs      []string
+	IndexFile string
+	mutex     sync.Mutex
+	scanMutex sync.Mutex
+	tracks    map[string]Track
+}
+
+func trackID(path string) string {
+	h := sha1.New()
+	h.Write([]byte(path))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func supported(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads the index written by the last scan. A missing index is not an
+// error, the library is empty until the first scan.
+func (l *Library) Load() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.tracks = make(map[string]Track)
+	b, err := os.ReadFile(l.IndexFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return errors.New("Error reading index: " + err.Error())
+	}
+	var tracks []Track
+	err = json.Unmarshal(b, &tracks)
+	if err != nil {
+		return errors.New("Error decoding index: " + err.Error())
+	}
+	for _, t := range tracks {
+		l.tracks[t.ID] = t
+	}
+	return nil
+}
+
+func (l *Library) save() error {
+	b, err := json.Marshal(l.Tracks())
+	if err != nil {
+		return errors.New("Error encoding index: " + err.Error())
+	}
+	tmp := l.IndexFile + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return errors.New("Error writing index: " + err.Error())
+	}
+	err = os.Rename(tmp, l.IndexFile)
+	if err != nil {
+		return errors.New("Error writing index: " + err.Error())
+	}
+	return nil
+}
+
+func readTags(path string, info fs.FileInfo) (Track, error) {
+	t := Track{
+		ID:      trackID(path),
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return t, errors.New("Error opening file: " + err.Error())
+	}
+	defer f.Close()
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		// Untagged files are still playable, they are named after the file
+		return t, nil
+	}
+	t.Title = m.Title()
+	t.Artist = m.Artist()
+	if t.Artist == "" {
+		t.Artist = m.AlbumArtist()
+	}
+	t.Album = m.Album()
+	return t, nil
+}
+
+// Scan walks the library directories and updates the index. Only files that
+// are new or changed since the last scan have their tags read. It returns the
+// number of tracks in the library. A scan that is cancelled through ctx
+// keeps the previous index.
+func (l *Library) Scan(ctx context.Context) (int, error) {
+	l.scanMutex.Lock()
+	defer l.scanMutex.Unlock()
+
+	l.mutex.Lock()
+	old := l.tracks
+	l.mutex.Unlock()
+
+	tracks := make(map[string]Track)
+	updated := 0
+	for _, dir := range l.Dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				log.Println("Error scanning " + path + ": " + err.Error())
+				return nil
+			}
+			if d.IsDir() || !supported(path) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				log.Println("Error scanning " + path + ": " + err.Error())
+				return nil
+			}
+			id := trackID(path)
+			t, ok := old[id]
+			if !ok || t.Size != info.Size() || !t.ModTime.Equal(info.ModTime()) {
+				t, err = readTags(path, info)
+				if err != nil {
+					log.Println("Error reading tags of " + path + ": " + err.Error())
+					return nil
+				}
+				updated++
+			}
+			tracks[id] = t
+			return nil
+		})
+		if err != nil {
+			return 0, errors.New("Error scanning " + dir + ": " + err.Error())
+		}
+	}
+
+	l.mutex.Lock()
+	l.tracks = tracks
+	l.mutex.Unlock()
+	log.Printf("Library scanned, %v tracks, %v new or changed", len(tracks), updated)
+	return len(tracks), l.save()
+}
+
+func (l *Library) Get(id string) (Track, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	t, ok := l.tracks[id]
+	return t, ok
+}
+
+// Tracks returns all tracks sorted by artist, album and title.
+func (l *Library) Tracks() []Track {
+	l.mutex.Lock()
+	tracks := make([]Track, 0, len(l.tracks))
+	for _, t := range l.tracks {
+		tracks = append(tracks, t)
+	}
+	l.mutex.Unlock()
+	sort.Slice(tracks, func(i, j int) bool {
+		if tracks[i].Artist != tracks[j].Artist {
+			return tracks[i].Artist < tracks[j].Artist
+		}
+		if tracks[i].Album != tracks[j].Album {
+			return tracks[i].Album < tracks[j].Album
+		}
+		return tracks[i].Name() < tracks[j].Name()
+	})
+	return tracks
+}
+
+// Search returns the tracks whose title, artist, album or file name contain
+// all words of the query. An empty query matches all tracks.
+func (l *Library) Search(query string, maxResults int) []Track {
+	words := strings.Fields(strings.ToLower(query))
+	results := []Track{}
+	for _, t := range l.Tracks() {
+		if maxResults > 0 && len(results) >= maxResults {
+			break
+		}
+		text := strings.ToLower(strings.Join([]string{t.Title, t.Artist, t.Album, filepath.Base(t.Path)}, " "))
+		match := true
+		for _, w := range words {
+			if !strings.Contains(text, w) {
+				match = false
+				break
+			}
+		}
+		if match {
+			results = append(results, t)
+		}
+	}
+	return results
+}
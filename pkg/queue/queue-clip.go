@@ -0,0 +1,31 @@
+package queue
+
+// clip checks start and end of an entry against its duration and shortens
+// the duration to the length of the clip. An end at or after the end of the
+// song is dropped.
+func clip(e *Entry) error {
+	if e.Start < 0 || e.End < 0 {
+		return permanentError("start and end must not be negative")
+	}
+	if e.End > 0 && e.End <= e.Start {
+		return permanentError("end must be after start")
+	}
+	if e.Duration == 0 {
+		if e.End > 0 {
+			e.Duration = e.End - e.Start
+		}
+		return nil
+	}
+	if e.Start >= e.Duration {
+		return permanentError("start is after the end of the song")
+	}
+	if e.End >= e.Duration {
+		e.End = 0
+	}
+	end := e.Duration
+	if e.End > 0 {
+		end = e.End
+	}
+	e.Duration = end - e.Start
+	return nil
+}
@@ -0,0 +1,74 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventEntryAdded   EventType = "entryadded"
+	EventStageChanged EventType = "stagechanged"
+	EventVoteChanged  EventType = "votechanged"
+	EventEntryDeleted EventType = "entrydeleted"
+	EventSongStarted  EventType = "songstarted"
+	EventSongSkipped  EventType = "songskipped"
+	EventSongPaused   EventType = "songpaused"
+	EventSongResumed  EventType = "songresumed"
+	EventPosition     EventType = "position"
+	// EventDownloadProgress carries the progress of an entry that is being
+	// downloaded
+	EventDownloadProgress EventType = "downloadprogress"
+)
+
+type Event struct {
+	Type     EventType     `json:"type"`
+	Stage    Stage         `json:"stage,omitempty"`
+	Entry    *Entry        `json:"entry,omitempty"`
+	Reason   string        `json:"reason,omitempty"`
+	Position time.Duration `json:"position,omitempty"`
+	Length   time.Duration `json:"length,omitempty"`
+}
+
+// EventBus fans out queue events to all subscribers. Subscribers that do not
+// keep up miss events instead of blocking the queues.
+type EventBus struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// Events is the bus all queues publish their changes on.
+var Events EventBus
+
+func (b *EventBus) Subscribe() chan Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Event]struct{})
+	}
+	ch := make(chan Event, 64)
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *EventBus) Unsubscribe(ch chan Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.subscribers, ch)
+}
+
+func (b *EventBus) Publish(ev Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func publishEntry(t EventType, stage Stage, e Entry) {
+	Events.Publish(Event{Type: t, Stage: stage, Entry: &e})
+}
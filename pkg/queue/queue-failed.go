@@ -0,0 +1,250 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// PermanentError marks an error that will not go away by retrying, like a
+// search without results.
+type PermanentError struct {
+	msg string
+}
+
+func (e PermanentError) Error() string {
+	return e.msg
+}
+
+func permanentError(msg string) error {
+	return PermanentError{msg}
+}
+
+func IsPermanent(err error) bool {
+	var p PermanentError
+	return errors.As(err, &p)
+}
+
+type FailedEntry struct {
+	Entry
+	Stage     Stage     `json:"stage"`
+	Reason    string    `json:"reason"`
+	Attempts  int       `json:"attempts"`
+	FailedAt  time.Time `json:"failedat"`
+	NextRetry time.Time `json:"nextretry"`
+	// Refunded entries were paid back, retrying them costs again
+	Refunded bool `json:"refunded,omitempty"`
+}
+
+type FailedQueue struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	mutex       sync.Mutex
+	entries     []FailedEntry
+	attempts    map[string]int
+	onChange    func()
+	wake        chan struct{}
+}
+
+func (q *FailedQueue) SetChangeHandler(f func()) {
+	q.onChange = f
+}
+
+func (q *FailedQueue) changed() {
+	if q.onChange != nil {
+		q.onChange()
+	}
+}
+
+// signal wakes up WaitDue, the caller must hold mutex.
+func (q *FailedQueue) signal() {
+	select {
+	case q.wakeup() <- struct{}{}:
+	default:
+	}
+}
+
+// wakeup returns the channel used to signal changes, the caller must hold
+// mutex.
+func (q *FailedQueue) wakeup() chan struct{} {
+	if q.wake == nil {
+		q.wake = make(chan struct{}, 1)
+	}
+	return q.wake
+}
+
+// Add records a failed entry. Unless the error is permanent or the entry ran
+// out of attempts, it is scheduled for another try with exponential backoff.
+func (q *FailedQueue) Add(e Entry, stage Stage, err error) FailedEntry {
+	q.mutex.Lock()
+	if q.attempts == nil {
+		q.attempts = make(map[string]int)
+	}
+	q.attempts[e.ID]++
+	fe := FailedEntry{
+		Entry:    e,
+		Stage:    stage,
+		Reason:   err.Error(),
+		Attempts: q.attempts[e.ID],
+		FailedAt: time.Now(),
+	}
+	if !IsPermanent(err) && fe.Attempts < q.MaxAttempts {
+		fe.NextRetry = fe.FailedAt.Add(q.Backoff << (fe.Attempts - 1))
+	}
+	q.entries = append(q.entries, fe)
+	q.signal()
+	q.mutex.Unlock()
+	q.changed()
+	Events.Publish(Event{Type: EventStageChanged, Stage: StageFailed, Entry: &e, Reason: fe.Reason})
+	return fe
+}
+
+// SetRefunded marks that the coins paid for a failed entry were given back.
+func (q *FailedQueue) SetRefunded(id string) {
+	q.mutex.Lock()
+	for i := range q.entries {
+		if q.entries[i].ID == id {
+			q.entries[i].Refunded = true
+		}
+	}
+	q.mutex.Unlock()
+	q.changed()
+}
+
+// Resolve forgets the attempts of an entry once it made it through a stage.
+func (q *FailedQueue) Resolve(id string) {
+	q.mutex.Lock()
+	delete(q.attempts, id)
+	q.mutex.Unlock()
+}
+
+func (q *FailedQueue) GetAllEntries() []FailedEntry {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	res := make([]FailedEntry, len(q.entries))
+	copy(res, q.entries)
+	return res
+}
+
+func (q *FailedQueue) GetEntry(id string) (FailedEntry, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, fe := range q.entries {
+		if fe.ID == id {
+			return fe, nil
+		}
+	}
+	return FailedEntry{}, errors.New("song not found")
+}
+
+func (q *FailedQueue) remove(id string) (FailedEntry, error) {
+	q.mutex.Lock()
+	for i, fe := range q.entries {
+		if fe.ID == id {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			q.mutex.Unlock()
+			q.changed()
+			return fe, nil
+		}
+	}
+	q.mutex.Unlock()
+	return FailedEntry{}, errors.New("song not found")
+}
+
+// Retry removes an entry from the failed queue so it can be put back into
+// its stage.
+func (q *FailedQueue) Retry(id string) (FailedEntry, error) {
+	return q.remove(id)
+}
+
+// Dismiss removes an entry from the failed queue for good.
+func (q *FailedQueue) Dismiss(id string) error {
+	fe, err := q.remove(id)
+	if err != nil {
+		return err
+	}
+	q.Resolve(id)
+	publishEntry(EventEntryDeleted, StageFailed, fe.Entry)
+	return nil
+}
+
+// PopDue removes and returns all entries whose next retry is due.
+func (q *FailedQueue) PopDue(now time.Time) []FailedEntry {
+	q.mutex.Lock()
+	due := []FailedEntry{}
+	rest := []FailedEntry{}
+	for _, fe := range q.entries {
+		if !fe.NextRetry.IsZero() && !fe.NextRetry.After(now) {
+			due = append(due, fe)
+		} else {
+			rest = append(rest, fe)
+		}
+	}
+	q.entries = rest
+	q.mutex.Unlock()
+	if len(due) > 0 {
+		q.changed()
+	}
+	return due
+}
+
+func (q *FailedQueue) nextRetry() (time.Time, bool) {
+	var next time.Time
+	for _, fe := range q.entries {
+		if fe.NextRetry.IsZero() {
+			continue
+		}
+		if next.IsZero() || fe.NextRetry.Before(next) {
+			next = fe.NextRetry
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// WaitDue blocks until at least one entry is due for a retry. It returns false
+// if ctx is cancelled first.
+func (q *FailedQueue) WaitDue(ctx context.Context) bool {
+	for {
+		q.mutex.Lock()
+		next, ok := q.nextRetry()
+		wake := q.wakeup()
+		q.mutex.Unlock()
+		var timer *time.Timer
+		var due <-chan time.Time
+		if ok {
+			wait := time.Until(next)
+			if wait <= 0 {
+				return true
+			}
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+		select {
+		case <-wake:
+		case <-due:
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return false
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (q *FailedQueue) restore(entries []FailedEntry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.entries = entries
+	q.attempts = make(map[string]int)
+	for i, fe := range q.entries {
+		if q.entries[i].votedFor == nil {
+			q.entries[i].votedFor = make(map[string]int)
+		}
+		q.attempts[fe.ID] = fe.Attempts
+	}
+	q.signal()
+}
@@ -0,0 +1,191 @@
+package queue
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Nerdbergev/rave2gether/pkg/cache"
+	"github.com/Nerdbergev/rave2gether/pkg/downloader"
+)
+
+// sourceKey identifies a song independent of how its URL was written, by
+// the extractor and id yt-dlp reports or else by its canonical URL.
+func sourceKey(e Entry) string {
+	if e.Extractor != "" && e.VideoID != "" {
+		return strings.ToLower(e.Extractor) + ":" + e.VideoID
+	}
+	return canonicalURL(e.URL)
+}
+
+// canonicalURL maps the URLs of a YouTube video to the key yt-dlp metadata
+// gives it. Other URLs lose their fragment and start time.
+func canonicalURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	switch host {
+	case "youtu.be":
+		if id := strings.Trim(u.Path, "/"); id != "" {
+			return "youtube:" + id
+		}
+	case "youtube.com", "m.youtube.com", "music.youtube.com":
+		if id := u.Query().Get("v"); id != "" {
+			return "youtube:" + id
+		}
+		if id, ok := strings.CutPrefix(u.Path, "/shorts/"); ok && id != "" {
+			return "youtube:" + strings.Trim(id, "/")
+		}
+	}
+	q := u.Query()
+	q.Del("t")
+	u.RawQuery = q.Encode()
+	u.Fragment = ""
+	return u.String()
+}
+
+func clipKey(e Entry) string {
+	if e.Start > 0 || e.End > 0 {
+		return fmt.Sprintf("#%v-%v", e.Start, e.End)
+	}
+	return ""
+}
+
+func sha1Hex(s string) string {
+	h := sha1.New()
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashEntry derives the name of the cached file from the source of the song.
+// Clips get their own, so they do not collide with the whole song.
+func hashEntry(e Entry) string {
+	return sha1Hex(sourceKey(e) + clipKey(e))
+}
+
+// legacyHash is how entries were hashed before, from their raw URL.
+func legacyHash(e Entry) string {
+	return sha1Hex(e.URL + clipKey(e))
+}
+
+// MigrateHashes renames cached songs that are named after the hash of their
+// raw URL to the hash of their source. The history, the cache index and the
+// queues are updated to match.
+func MigrateHashes(folder string, c *cache.Cache, dq *DownloadQueue, plq *PlayQueue, fq *FailedQueue) error {
+	history, err := ReadHistory(folder)
+	if err != nil {
+		return err
+	}
+	entries := append([]Entry{}, history...)
+	entries = append(entries, dq.GetAllEntries()...)
+	entries = append(entries, plq.GetAllEntries()...)
+	for _, fe := range fq.GetAllEntries() {
+		entries = append(entries, fe.Entry)
+	}
+	items, err := c.Search("")
+	if err != nil {
+		return err
+	}
+	for _, i := range items {
+		entries = append(entries, Entry{URL: i.URL, Hash: i.Hash})
+	}
+
+	renames := make(map[string]string)
+	for _, e := range entries {
+		if e.URL == "" || e.Hash != legacyHash(e) {
+			continue
+		}
+		if n := hashEntry(e); n != e.Hash {
+			renames[e.Hash] = n
+		}
+	}
+	if len(renames) == 0 {
+		return nil
+	}
+	log.Printf("Migrating %v songs to source hashes", len(renames))
+
+	for old, n := range renames {
+		oldPath, ok := downloader.CachedFile(folder, old)
+		if !ok {
+			continue
+		}
+		newPath, exists := downloader.CachedFile(folder, n)
+		if exists {
+			// The same song was downloaded under another URL before
+			err = os.Remove(oldPath)
+		} else {
+			newPath = filepath.Join(folder, n) + filepath.Ext(oldPath)
+			err = os.Rename(oldPath, newPath)
+		}
+		if err != nil {
+			return errors.New("Error migrating " + old + ": " + err.Error())
+		}
+		err = c.Rename(old, n, newPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rehashHistory(folder, renames)
+	if err != nil {
+		return err
+	}
+	dq.rehash(renames)
+	plq.rehash(renames)
+	fq.rehash(renames)
+	return nil
+}
+
+func rehashHistory(folder string, renames map[string]string) error {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	history, err := ReadHistory(folder)
+	if err != nil || len(history) == 0 {
+		return err
+	}
+	for i, e := range history {
+		if n, ok := renames[e.Hash]; ok {
+			history[i].Hash = n
+		}
+	}
+	historyJSON, err := json.MarshalIndent(history, "", "    ")
+	if err != nil {
+		return errors.New("Error marshalling history: " + err.Error())
+	}
+	err = os.WriteFile(filepath.Join(folder, HistoryFile), historyJSON, 0644)
+	if err != nil {
+		return errors.New("Error writing history file: " + err.Error())
+	}
+	return nil
+}
+
+func (q *Queue) rehash(renames map[string]string) {
+	q.EntryMutex.Lock()
+	for i, e := range q.Entries {
+		if n, ok := renames[e.Hash]; ok {
+			q.Entries[i].Hash = n
+		}
+	}
+	q.EntryMutex.Unlock()
+	q.changed()
+}
+
+func (q *FailedQueue) rehash(renames map[string]string) {
+	q.mutex.Lock()
+	for i, fe := range q.entries {
+		if n, ok := renames[fe.Hash]; ok {
+			q.entries[i].Hash = n
+		}
+	}
+	q.mutex.Unlock()
+	q.changed()
+}
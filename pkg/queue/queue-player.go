@@ -0,0 +1,188 @@
+package queue
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Nerdbergev/rave2gether/pkg/downloader"
+	"github.com/gopxl/beep/v2"
+	"github.com/gopxl/beep/v2/effects"
+	"github.com/gopxl/beep/v2/flac"
+	"github.com/gopxl/beep/v2/mp3"
+	"github.com/gopxl/beep/v2/speaker"
+	"github.com/gopxl/beep/v2/vorbis"
+	"github.com/gopxl/beep/v2/wav"
+)
+
+const maxBoost = 6.0
+
+// fader ramps the gain of a streamer along an equal power curve, so two
+// tracks fading in and out at the same time keep a constant loudness. A
+// fader that faded out ends its stream. Its fields must only be touched with
+// the speaker locked.
+type fader struct {
+	Streamer beep.Streamer
+	progress float64
+	step     float64
+}
+
+func (f *fader) Stream(samples [][2]float64) (n int, ok bool) {
+	if f.step < 0 && f.progress <= 0 {
+		return 0, false
+	}
+	n, ok = f.Streamer.Stream(samples)
+	for i := range samples[:n] {
+		gain := math.Sin(f.progress * math.Pi / 2)
+		samples[i][0] *= gain
+		samples[i][1] *= gain
+		f.progress = math.Max(0, math.Min(1, f.progress+f.step))
+	}
+	return n, ok
+}
+
+func (f *fader) Err() error {
+	return f.Streamer.Err()
+}
+
+// fade starts to fade in or out over the given number of samples.
+func (f *fader) fade(in bool, samples int) {
+	if samples < 1 {
+		samples = 1
+	}
+	f.step = 1 / float64(samples)
+	if !in {
+		f.step = -f.step
+	}
+}
+
+// track is a song that is loaded into the speaker.
+type track struct {
+	entry    Entry
+	file     *os.File
+	streamer beep.StreamSeekCloser
+	format   beep.Format
+	gain     *effects.Volume
+	fader    *fader
+	ctrl     *beep.Ctrl
+	ended    chan struct{}
+	// normGain is the gain in dB that brings the track to the target loudness
+	normGain float64
+}
+
+// handover is a track that fades out while the next one fades in.
+type handover struct {
+	track    *track
+	midpoint time.Time
+	end      time.Time
+}
+
+// decode picks the decoder by the file extension.
+func decode(f *os.File) (beep.StreamSeekCloser, beep.Format, error) {
+	switch ext := strings.ToLower(filepath.Ext(f.Name())); ext {
+	case ".mp3":
+		return mp3.Decode(f)
+	case ".flac":
+		return flac.Decode(f)
+	case ".ogg", ".oga":
+		return vorbis.Decode(f)
+	case ".wav":
+		return wav.Decode(f)
+	default:
+		return nil, beep.Format{}, errors.New("unsupported file type " + ext)
+	}
+}
+
+func openTrack(e Entry, folder string) (*track, error) {
+	fp := e.Path
+	if fp == "" {
+		var ok bool
+		fp, ok = downloader.CachedFile(folder, e.Hash)
+		if !ok {
+			return nil, errors.New("Error opening file: " + e.Hash + " is not downloaded")
+		}
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, errors.New("Error opening file: " + err.Error())
+	}
+
+	streamer, format, err := decode(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.New("Error decoding file: " + err.Error())
+	}
+
+	t := &track{
+		entry:    e,
+		file:     f,
+		streamer: streamer,
+		format:   format,
+		ended:    make(chan struct{}),
+	}
+	resampled := beep.Resample(4, format.SampleRate, sampleRate, streamer)
+	t.gain = &effects.Volume{Streamer: resampled}
+	t.fader = &fader{Streamer: t.gain, progress: 1}
+	t.ctrl = &beep.Ctrl{Streamer: beep.Seq(t.fader, beep.Callback(func() {
+		close(t.ended)
+	}))}
+	return t, nil
+}
+
+// position returns the position and length of the track.
+func (t *track) position() (time.Duration, time.Duration) {
+	speaker.Lock()
+	defer speaker.Unlock()
+	return t.format.SampleRate.D(t.streamer.Position()), t.format.SampleRate.D(t.streamer.Len())
+}
+
+func (t *track) seek(position time.Duration) error {
+	speaker.Lock()
+	defer speaker.Unlock()
+	if position < 0 || position >= t.format.SampleRate.D(t.streamer.Len()) {
+		return errors.New("position out of range")
+	}
+	return t.streamer.Seek(t.format.SampleRate.N(position))
+}
+
+func (t *track) fade(in bool, d time.Duration) {
+	speaker.Lock()
+	if in {
+		t.fader.progress = 0
+	}
+	t.fader.fade(in, sampleRate.N(d))
+	speaker.Unlock()
+}
+
+// stop takes the track out of the speaker and closes its file.
+func (t *track) stop() {
+	speaker.Lock()
+	t.ctrl.Streamer = nil
+	speaker.Unlock()
+	t.streamer.Close()
+	t.file.Close()
+}
+
+// normalize sets the gain needed to bring the track from its measured
+// loudness to target. Quiet tracks are boosted by at most maxBoost to avoid
+// clipping.
+func (t *track) normalize(target float64) {
+	if t.entry.Loudness == 0 {
+		return
+	}
+	t.normGain = math.Min(target-t.entry.Loudness, maxBoost)
+}
+
+// setVolume sets the volume in percent on top of the normalization gain.
+// The caller must hold the speaker lock once the track is playing.
+func (t *track) setVolume(percent int) {
+	t.gain.Base = 2
+	t.gain.Silent = percent == 0
+	if !t.gain.Silent {
+		t.gain.Volume = math.Log2(float64(percent)/100) + t.normGain/20*math.Log2(10)
+	}
+}
@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// RejectedError is a permanent error for entries the admission policy does
+// not let in.
+type RejectedError struct {
+	PermanentError
+}
+
+func (e RejectedError) Unwrap() error {
+	return e.PermanentError
+}
+
+func rejectedError(msg string) error {
+	return RejectedError{PermanentError{"rejected: " + msg}}
+}
+
+func IsRejected(err error) bool {
+	var r RejectedError
+	return errors.As(err, &r)
+}
+
+// Policy decides which prepared entries may be downloaded. Zero values turn
+// a check off.
+type Policy struct {
+	MinDuration     time.Duration
+	MaxDuration     time.Duration
+	BlockedKeywords []string
+	BlockedChannels []string
+}
+
+// Check returns a RejectedError with the reason if the entry is not allowed.
+func (p Policy) Check(e Entry) error {
+	if p.MaxDuration > 0 {
+		if e.Duration == 0 {
+			return rejectedError("length is unknown, it could be a live stream")
+		}
+		if e.Duration > p.MaxDuration {
+			return rejectedError("longer than " + p.MaxDuration.String())
+		}
+	}
+	if p.MinDuration > 0 && e.Duration > 0 && e.Duration < p.MinDuration {
+		return rejectedError("shorter than " + p.MinDuration.String())
+	}
+	title := strings.ToLower(e.Name)
+	for _, k := range p.BlockedKeywords {
+		if k != "" && strings.Contains(title, strings.ToLower(k)) {
+			return rejectedError("title contains blocked keyword " + k)
+		}
+	}
+	for _, c := range p.BlockedChannels {
+		if c != "" && (strings.EqualFold(c, e.Channel) || strings.EqualFold(c, e.Artist)) {
+			return rejectedError("channel " + c + " is blocked")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nerdbergev/rave2gether/pkg/downloader"
+)
+
+const baseURL = "https://www.googleapis.com/youtube/v3/search"
+const videosURL = "https://www.googleapis.com/youtube/v3/videos"
+
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)D)?T?(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?$`)
+
+type SearchResult struct {
+	Title     string        `json:"title"`
+	URL       string        `json:"url"`
+	Channel   string        `json:"channel"`
+	Duration  time.Duration `json:"duration"`
+	Thumbnail string        `json:"thumbnail"`
+}
+
+// SearchProvider turns a text query into songs that can be downloaded.
+type SearchProvider interface {
+	Name() string
+	Search(ctx context.Context, query string, maxResults int) ([]SearchResult, error)
+}
+
+// Search asks the providers in order and returns the results of the first
+// one that finds something.
+func Search(ctx context.Context, providers []SearchProvider, query string, maxResults int) ([]SearchResult, error) {
+	var errs []string
+	permanent := true
+	for _, p := range providers {
+		results, err := p.Search(ctx, query, maxResults)
+		if err != nil {
+			log.Println("Error searching with " + p.Name() + ": " + err.Error())
+			errs = append(errs, p.Name()+": "+err.Error())
+			permanent = permanent && IsPermanent(err)
+			continue
+		}
+		if len(results) > 0 {
+			return results, nil
+		}
+	}
+	if len(errs) == 0 {
+		return nil, permanentError("no results found")
+	}
+	msg := strings.Join(errs, ", ")
+	if permanent {
+		return nil, permanentError(msg)
+	}
+	return nil, errors.New(msg)
+}
+
+type YouTubeVideosResponse struct {
+	Items []struct {
+		ID             string `json:"id"`
+		ContentDetails struct {
+			Duration string `json:"duration"`
+		} `json:"contentDetails"`
+	} `json:"items"`
+}
+
+// parseISODuration parses the ISO 8601 durations of the YouTube API, like
+// PT4M13S.
+func parseISODuration(s string) time.Duration {
+	m := isoDuration.FindStringSubmatch(s)
+	if m == nil {
+		return 0
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		n, _ := strconv.Atoi(m[i+1])
+		d += time.Duration(n) * unit
+	}
+	return d
+}
+
+type YouTubeResponse struct {
+	Items []struct {
+		ID struct {
+			VideoID string `json:"videoId"`
+		} `json:"id"`
+		Snippet struct {
+			Title        string `json:"title"`
+			ChannelTitle string `json:"channelTitle"`
+			Thumbnails   struct {
+				Default struct {
+					URL string `json:"url"`
+				} `json:"default"`
+			} `json:"thumbnails"`
+		} `json:"snippet"`
+	} `json:"items"`
+}
+
+// YouTubeProvider searches with the YouTube Data API.
+type YouTubeProvider struct {
+	APIKey string
+}
+
+func (p YouTubeProvider) Name() string {
+	return "youtube"
+}
+
+func (p YouTubeProvider) Search(ctx context.Context, query string, maxResults int) ([]SearchResult, error) {
+	if p.APIKey == "" {
+		return nil, permanentError("API key not set")
+	}
+	// Prepare the API request
+	params := url.Values{}
+	params.Add("part", "snippet")
+	params.Add("q", query)
+	params.Add("type", "video")
+	params.Add("maxResults", fmt.Sprintf("%d", maxResults))
+	params.Add("key", p.APIKey)
+
+	// Create the request URL
+	requestURL := fmt.Sprintf("%s?%s", baseURL, params.Encode())
+
+	// Perform the HTTP request
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating API request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making API request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Check for a non-200 status code
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error: received status code %d", resp.StatusCode)
+	}
+
+	// Decode the JSON response
+	var response YouTubeResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding response: %v", err)
+	}
+
+	// Extract video titles and IDs
+	results := []SearchResult{}
+	ids := []string{}
+	for _, item := range response.Items {
+		results = append(results, SearchResult{
+			Title:     html.UnescapeString(item.Snippet.Title),
+			URL:       fmt.Sprintf("https://www.youtube.com/watch?v=%s", item.ID.VideoID),
+			Channel:   html.UnescapeString(item.Snippet.ChannelTitle),
+			Thumbnail: item.Snippet.Thumbnails.Default.URL,
+		})
+		ids = append(ids, item.ID.VideoID)
+	}
+
+	// The search does not return durations, they need another request
+	durations, err := p.durations(ctx, ids)
+	if err != nil {
+		log.Println("Error getting durations: " + err.Error())
+		return results, nil
+	}
+	for i := range results {
+		results[i].Duration = durations[ids[i]]
+	}
+
+	return results, nil
+}
+
+func (p YouTubeProvider) durations(ctx context.Context, ids []string) (map[string]time.Duration, error) {
+	params := url.Values{}
+	params.Add("part", "contentDetails")
+	params.Add("id", strings.Join(ids, ","))
+	params.Add("key", p.APIKey)
+	requestURL := fmt.Sprintf("%s?%s", videosURL, params.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating API request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making API request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error: received status code %d", resp.StatusCode)
+	}
+
+	var response YouTubeVideosResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding response: %v", err)
+	}
+
+	durations := make(map[string]time.Duration)
+	for _, item := range response.Items {
+		durations[item.ID] = parseISODuration(item.ContentDetails.Duration)
+	}
+	return durations, nil
+}
+
+// YTDLPProvider searches YouTube through yt-dlp, which needs no API key.
+type YTDLPProvider struct{}
+
+type ytdlpSearchResult struct {
+	Title      string  `json:"title"`
+	URL        string  `json:"url"`
+	Channel    string  `json:"channel"`
+	Uploader   string  `json:"uploader"`
+	Duration   float64 `json:"duration"`
+	Thumbnails []struct {
+		URL string `json:"url"`
+	} `json:"thumbnails"`
+}
+
+func (p YTDLPProvider) Name() string {
+	return "ytdlp"
+}
+
+func (p YTDLPProvider) Search(ctx context.Context, query string, maxResults int) ([]SearchResult, error) {
+	cmd := exec.CommandContext(ctx, "yt-dlp", "--flat-playlist", "--dump-json", fmt.Sprintf("ytsearch%d:%s", maxResults, query))
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, errors.New("Error running yt-dlp: " + err.Error() + ": " + stderr.String())
+	}
+
+	results := []SearchResult{}
+	scanner := bufio.NewScanner(&out)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r ytdlpSearchResult
+		err := json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			return nil, errors.New("Error decoding yt-dlp output: " + err.Error())
+		}
+		res := SearchResult{
+			Title:    r.Title,
+			URL:      r.URL,
+			Channel:  r.Channel,
+			Duration: time.Duration(r.Duration * float64(time.Second)),
+		}
+		if res.Channel == "" {
+			res.Channel = r.Uploader
+		}
+		if len(r.Thumbnails) > 0 {
+			res.Thumbnail = r.Thumbnails[len(r.Thumbnails)-1].URL
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// HistoryProvider searches the history for songs that were played before and
+// are still in the music dir. They are not downloaded again, but their URL
+// is still looked up online when they are prepared.
+type HistoryProvider struct {
+	MusicDir string
+}
+
+func (p HistoryProvider) Name() string {
+	return "history"
+}
+
+func (p HistoryProvider) Search(ctx context.Context, query string, maxResults int) ([]SearchResult, error) {
+	history, err := ReadHistory(p.MusicDir)
+	if err != nil {
+		return nil, err
+	}
+	words := strings.Fields(strings.ToLower(query))
+	seen := make(map[string]bool)
+	results := []SearchResult{}
+	// Newest first, the history is appended to
+	for i := len(history) - 1; i >= 0 && len(results) < maxResults; i-- {
+		e := history[i]
+		if seen[e.Hash] || e.URL == "" {
+			continue
+		}
+		name := strings.ToLower(e.Name)
+		match := len(words) > 0
+		for _, w := range words {
+			if !strings.Contains(name, w) {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		if _, ok := downloader.CachedFile(p.MusicDir, e.Hash); !ok {
+			continue
+		}
+		seen[e.Hash] = true
+		results = append(results, SearchResult{Title: e.Name, URL: e.URL})
+	}
+	return results, nil
+}
@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+type savedEntry struct {
+	Entry
+	VotedFor map[string]int `json:"votedfor"`
+}
+
+type queueState struct {
+	PrepareQueue  []savedEntry  `json:"preparequeue"`
+	DownloadQueue []savedEntry  `json:"downloadqueue"`
+	PlayQueue     []savedEntry  `json:"playqueue"`
+	FailedQueue   []FailedEntry `json:"failedqueue"`
+	Volume        *int          `json:"volume,omitempty"`
+}
+
+var stateMutex sync.Mutex
+
+func saveEntry(e Entry) savedEntry {
+	votes := make(map[string]int, len(e.votedFor))
+	for k, v := range e.votedFor {
+		votes[k] = v
+	}
+	return savedEntry{e, votes}
+}
+
+func restoreEntry(s savedEntry) Entry {
+	e := s.Entry
+	e.votedFor = s.VotedFor
+	// A download that was cut off starts over
+	e.Progress = nil
+	if e.votedFor == nil {
+		e.votedFor = make(map[string]int)
+	}
+	return e
+}
+
+// snapshot returns the entries of the queue. Entries that are currently being
+// worked on are put back in front, so they are picked up again after a restart.
+func (q *Queue) snapshot(current ...Entry) []savedEntry {
+	res := []savedEntry{}
+	for _, e := range current {
+		if e.ID != "" {
+			res = append(res, saveEntry(e))
+		}
+	}
+	q.EntryMutex.Lock()
+	for _, e := range q.Entries {
+		res = append(res, saveEntry(e))
+	}
+	q.EntryMutex.Unlock()
+	return res
+}
+
+func (q *Queue) restore(entries []savedEntry) {
+	q.EntryMutex.Lock()
+	defer q.EntryMutex.Unlock()
+	q.Entries = make([]Entry, 0, len(entries))
+	for _, s := range entries {
+		q.Entries = append(q.Entries, restoreEntry(s))
+	}
+}
+
+func SaveState(filename string, pq *PrepareQueue, dq *DownloadQueue, plq *PlayQueue, fq *FailedQueue) error {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	volume := plq.Volume()
+	state := queueState{
+		PrepareQueue:  pq.snapshot(pq.CurrentEntry()),
+		DownloadQueue: dq.snapshot(dq.GetActiveEntries()...),
+		PlayQueue:     plq.snapshot(),
+		FailedQueue:   fq.GetAllEntries(),
+		Volume:        &volume,
+	}
+	stateJSON, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return errors.New("Error marshalling queue state: " + err.Error())
+	}
+	tmp := filename + ".tmp"
+	err = os.WriteFile(tmp, stateJSON, 0644)
+	if err != nil {
+		return errors.New("Error writing queue state file: " + err.Error())
+	}
+	err = os.Rename(tmp, filename)
+	if err != nil {
+		return errors.New("Error replacing queue state file: " + err.Error())
+	}
+	return nil
+}
+
+func LoadState(filename string, pq *PrepareQueue, dq *DownloadQueue, plq *PlayQueue, fq *FailedQueue) error {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	stateFile, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return errors.New("Error reading queue state file: " + err.Error())
+	}
+	var state queueState
+	err = json.Unmarshal(stateFile, &state)
+	if err != nil {
+		return errors.New("Error unmarshalling queue state file: " + err.Error())
+	}
+	pq.restore(state.PrepareQueue)
+	dq.restore(state.DownloadQueue)
+	plq.restore(state.PlayQueue)
+	// Older states only had songs in the play queue once they were downloaded
+	queued := plq.Positions()
+	downloading := make(map[string]bool)
+	for _, e := range dq.GetAllEntries() {
+		downloading[e.ID] = true
+		if _, ok := queued[e.ID]; !ok {
+			plq.AddPending(e)
+		}
+	}
+	// A pending song that is in no download queue would never be played
+	for _, e := range plq.GetAllEntries() {
+		if e.Pending && !downloading[e.ID] {
+			e.Pending = false
+			e.votedFor = make(map[string]int)
+			dq.push(e)
+		}
+	}
+	plq.SortEntries()
+	if state.Volume != nil {
+		err = plq.SetVolume(*state.Volume)
+		if err != nil {
+			return errors.New("Error restoring volume: " + err.Error())
+		}
+	}
+	fq.restore(state.FailedQueue)
+	return nil
+}
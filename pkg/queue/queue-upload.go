@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Nerdbergev/rave2gether/pkg/downloader"
+	"github.com/Nerdbergev/rave2gether/pkg/user"
+	"github.com/google/uuid"
+)
+
+// UploadExtractor marks entries that were uploaded instead of downloaded.
+const UploadExtractor = "upload"
+
+// StoreUpload saves an uploaded audio file in folder under the hash of its
+// content. The file is decoded first, anything that can not be played is
+// rejected. It returns the hash and the length of the song.
+func StoreUpload(src io.Reader, filename string, folder string) (string, time.Duration, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if !slices.Contains(downloader.Extensions, ext) {
+		return "", 0, errors.New("unsupported file type, use " + strings.Join(downloader.Extensions, ", "))
+	}
+	tmp, err := os.CreateTemp(folder, ".upload-*"+ext)
+	if err != nil {
+		return "", 0, errors.New("Error creating file: " + err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha1.New()
+	_, err = io.Copy(tmp, io.TeeReader(src, h))
+	if err != nil {
+		return "", 0, errors.New("Error storing upload: " + err.Error())
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", 0, errors.New("Error storing upload: " + err.Error())
+	}
+	streamer, format, err := decode(tmp)
+	if err != nil {
+		return "", 0, errors.New("Error decoding file: " + err.Error())
+	}
+	length := format.SampleRate.D(streamer.Len())
+	streamer.Close()
+	if length <= 0 {
+		return "", 0, errors.New("file contains no audio")
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	if _, ok := downloader.CachedFile(folder, hash); ok {
+		return hash, length, nil
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(folder, hash)+ext)
+	if err != nil {
+		return "", 0, errors.New("Error storing upload: " + err.Error())
+	}
+	return hash, length, nil
+}
+
+// AddUpload adds a song stored with StoreUpload, it goes straight to the
+// play queue.
+func (q *PlayQueue) AddUpload(name string, hash string, length time.Duration, user user.User) error {
+	e := Entry{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Hash:      hash,
+		Duration:  length,
+		Extractor: UploadExtractor,
+		AddedBy:   user.Username,
+		AddedAt:   time.Now(),
+		votedFor:  make(map[string]int),
+	}
+	ok, err := q.Admit(e, q.Stage)
+	if !ok {
+		return err
+	}
+	log.Println("Adding uploaded song to play queue: " + e.Name)
+	q.push(e)
+	q.SortEntries()
+	publishEntry(EventEntryAdded, q.Stage, e)
+	return nil
+}
+
+// CountUploads returns how many uploads of a user are waiting to be played.
+func (q *PlayQueue) CountUploads(username string) int {
+	q.EntryMutex.Lock()
+	defer q.EntryMutex.Unlock()
+	n := 0
+	for _, e := range q.Entries {
+		if e.Extractor == UploadExtractor && e.AddedBy == username {
+			n++
+		}
+	}
+	return n
+}
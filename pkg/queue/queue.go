@@ -1,89 +1,131 @@
 package queue
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha1"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"html"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/Nerdbergev/rave2gether/pkg/cache"
 	"github.com/Nerdbergev/rave2gether/pkg/downloader"
+	"github.com/Nerdbergev/rave2gether/pkg/library"
 	"github.com/Nerdbergev/rave2gether/pkg/user"
 	"github.com/google/uuid"
 	"github.com/gopxl/beep/v2"
-	"github.com/gopxl/beep/v2/mp3"
 	"github.com/gopxl/beep/v2/speaker"
 )
 
 const (
 	HistoryFile                 = "history.json"
+	StateFile                   = "queues.json"
 	sampleRate  beep.SampleRate = 44100
+	// progressInterval is how often download progress is published
+	progressInterval = time.Second
 )
 
-const baseURL = "https://www.googleapis.com/youtube/v3/search"
-
-type YouTubeResponse struct {
-	Items []struct {
-		ID struct {
-			VideoID string `json:"videoId"`
-		} `json:"id"`
-		Snippet struct {
-			Title string `json:"title"`
-		} `json:"snippet"`
-	} `json:"items"`
-}
-
 type SongInfo struct {
 	Entry
 	Position time.Duration `json:"position"`
 	Length   time.Duration `json:"length"`
+	Paused   bool          `json:"paused"`
 	Mutex    sync.Mutex    `json:"-"`
 }
 
+type Stage string
+
+const (
+	StagePrepare  Stage = "prepare"
+	StageDownload Stage = "download"
+	StagePlay     Stage = "play"
+	StageFailed   Stage = "failed"
+)
+
 type Queue struct {
+	Stage      Stage
 	MusicDir   string
 	EntryMutex sync.Mutex
 	Entries    []Entry
 	SongInfo   SongInfo
+	onChange   func()
+	wake       chan struct{}
 }
 
 type PrepareQueue struct {
-	APIKey string
+	Providers     []SearchProvider
+	PlaylistLimit int
+	Policy        Policy
+	// Charge is called for every track of a playlist after the first one and
+	// stops the expansion when it returns false
+	Charge func(username string) bool
 	Queue
 }
 
 type DownloadQueue struct {
 	Queue
+	// Positions returns the play order, the song played first is downloaded
+	// first
+	Positions       func() map[string]int
+	Cache           *cache.Cache
+	AudioFormat     string
+	AnalyzeLoudness bool
+	activeMutex     sync.Mutex
+	active          []Entry
 }
 
 type PlayQueue struct {
 	Queue
 	ctx        context.Context
 	cancelFunc context.CancelFunc
+	Crossfade  time.Duration
+	Cooldown   time.Duration
+	// Cache, if set, records which songs are played
+	Cache          *cache.Cache
+	Normalize      bool
+	LoudnessTarget float64
+	playerMutex    sync.Mutex
+	current        *track
+	handover       *handover
+	seeks          chan seekRequest
+	volume         int
+}
+
+type seekRequest struct {
+	position time.Duration
+	result   chan error
 }
 
 type Entry struct {
-	ID       string    `json:"id"`
-	Name     string    `json:"name"`
-	URL      string    `json:"url"`
-	Hash     string    `json:"hash"`
-	AddedBy  string    `json:"addedby"`
-	AddedAt  time.Time `json:"addedat"`
-	PlayedAt time.Time `json:"playedat"`
-	Points   int       `json:"points"`
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	URL       string        `json:"url"`
+	Hash      string        `json:"hash"`
+	AddedBy   string        `json:"addedby"`
+	AddedAt   time.Time     `json:"addedat"`
+	PlayedAt  time.Time     `json:"playedat"`
+	Points    int           `json:"points"`
+	Loudness  float64       `json:"loudness,omitempty"`
+	Duration  time.Duration `json:"duration,omitempty"`
+	Artist    string        `json:"artist,omitempty"`
+	Channel   string        `json:"channel,omitempty"`
+	Thumbnail string        `json:"thumbnail,omitempty"`
+	VideoID   string        `json:"videoid,omitempty"`
+	Extractor string        `json:"extractor,omitempty"`
+	// Start and End cut a clip out of the song, an End of 0 is the end
+	Start time.Duration `json:"start,omitempty"`
+	End   time.Duration `json:"end,omitempty"`
+	// Pending songs are in the play queue but still need to be downloaded
+	Pending bool `json:"pending,omitempty"`
+	// Path is set for songs of the local library, they are played from there
+	Path string `json:"path,omitempty"`
+	// Progress is set while the song is being downloaded
+	Progress *downloader.Progress `json:"progress,omitempty"`
 	votedFor map[string]int
 }
 
@@ -106,19 +148,48 @@ func isValidUrl(toTest string) bool {
 	return true
 }
 
-func WriteHistory(e Entry, folder string) error {
+func ReadHistory(folder string) ([]Entry, error) {
 	var history []Entry
 	fp := filepath.Join(folder, HistoryFile)
 	if _, err := os.Stat(fp); err == nil {
 		historyFile, err := os.ReadFile(fp)
 		if err != nil {
-			return errors.New("Error reading history file: " + err.Error())
+			return nil, errors.New("Error reading history file: " + err.Error())
 		}
 		err = json.Unmarshal(historyFile, &history)
 		if err != nil {
-			return errors.New("Error unmarshalling history file: " + err.Error())
+			return nil, errors.New("Error unmarshalling history file: " + err.Error())
 		}
 	}
+	return history, nil
+}
+
+var historyMutex sync.Mutex
+
+// LastPlayed returns when a song was last played according to the history,
+// or the zero time if it never was.
+func LastPlayed(folder string, hash string) (time.Time, error) {
+	history, err := ReadHistory(folder)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var last time.Time
+	for _, e := range history {
+		if e.Hash == hash && e.PlayedAt.After(last) {
+			last = e.PlayedAt
+		}
+	}
+	return last, nil
+}
+
+func WriteHistory(e Entry, folder string) error {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	history, err := ReadHistory(folder)
+	if err != nil {
+		return err
+	}
+	fp := filepath.Join(folder, HistoryFile)
 	history = append(history, e)
 	historyJSON, err := json.MarshalIndent(history, "", "    ")
 	if err != nil {
@@ -132,64 +203,103 @@ func WriteHistory(e Entry, folder string) error {
 	return nil
 }
 
-func searchYouTube(query string, maxResults int, apiKey string) ([]map[string]string, error) {
-	if apiKey == "" {
-		return nil, errors.New("API key not set")
-	}
-	// Prepare the API request
-	params := url.Values{}
-	params.Add("part", "snippet")
-	params.Add("q", query)
-	params.Add("type", "video")
-	params.Add("maxResults", fmt.Sprintf("%d", maxResults))
-	params.Add("key", apiKey)
-
-	// Create the request URL
-	requestURL := fmt.Sprintf("%s?%s", baseURL, params.Encode())
+// SetChangeHandler registers f to be called after every change to the queue.
+func (q *Queue) SetChangeHandler(f func()) {
+	q.onChange = f
+}
 
-	// Perform the HTTP request
-	resp, err := http.Get(requestURL)
-	if err != nil {
-		return nil, fmt.Errorf("error making API request: %v", err)
+func (q *Queue) changed() {
+	if q.onChange != nil {
+		q.onChange()
 	}
-	defer resp.Body.Close()
+}
 
-	// Check for a non-200 status code
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("error: received status code %d", resp.StatusCode)
+// wakeup returns the channel used to signal new entries, the caller must hold
+// EntryMutex.
+func (q *Queue) wakeup() chan struct{} {
+	if q.wake == nil {
+		q.wake = make(chan struct{}, 1)
 	}
+	return q.wake
+}
 
-	// Decode the JSON response
-	var response YouTubeResponse
-	err = json.NewDecoder(resp.Body).Decode(&response)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding response: %v", err)
-	}
+// Wait blocks until the queue has at least one entry. It returns false if ctx
+// is cancelled first.
+func (q *Queue) Wait(ctx context.Context) bool {
+	return q.waitFor(ctx, func() bool {
+		return len(q.Entries) > 0
+	})
+}
 
-	// Extract video titles and IDs
-	results := []map[string]string{}
-	for _, item := range response.Items {
-		results = append(results, map[string]string{
-			"title": item.Snippet.Title,
-			"url":   fmt.Sprintf("https://www.youtube.com/watch?v=%s", item.ID.VideoID),
-		})
+// waitFor blocks until ready returns true, it is called with EntryMutex held
+// whenever the queue is woken up.
+func (q *Queue) waitFor(ctx context.Context, ready func() bool) bool {
+	for {
+		q.EntryMutex.Lock()
+		if ready() {
+			q.EntryMutex.Unlock()
+			return true
+		}
+		wake := q.wakeup()
+		q.EntryMutex.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return false
+		}
 	}
-
-	return results, nil
 }
 
 func (q *Queue) PopEntry() Entry {
 	q.EntryMutex.Lock()
-	defer q.EntryMutex.Unlock()
 	e := q.Entries[0]
 	q.Entries = q.Entries[1:]
+	q.EntryMutex.Unlock()
+	q.changed()
 	return e
 }
 
+func (q *Queue) PushEntry(e Entry) {
+	q.push(e)
+	publishEntry(EventStageChanged, q.Stage, e)
+}
+
+func (q *Queue) push(e Entry) {
+	q.EntryMutex.Lock()
+	q.Entries = append(q.Entries, e)
+	select {
+	case q.wakeup() <- struct{}{}:
+	default:
+	}
+	q.EntryMutex.Unlock()
+	q.changed()
+}
+
+// requeue puts an entry that could not be finished because of a shutdown back
+// in front of the queue.
+func (q *Queue) requeue(e Entry) {
+	q.pushFront(e)
+}
+
+func (q *Queue) pushFront(entries ...Entry) {
+	q.EntryMutex.Lock()
+	q.Entries = append(entries, q.Entries...)
+	select {
+	case q.wakeup() <- struct{}{}:
+	default:
+	}
+	q.EntryMutex.Unlock()
+	q.changed()
+}
+
+// GetAllEntries returns a copy of the entries, the queue may change while
+// the caller goes through them.
 func (q *Queue) GetAllEntries() []Entry {
 	q.EntryMutex.Lock()
 	defer q.EntryMutex.Unlock()
-	return q.Entries
+	res := make([]Entry, len(q.Entries))
+	copy(res, q.Entries)
+	return res
 }
 
 func (q *Queue) GetEntryCount() int {
@@ -209,73 +319,391 @@ func (q *PlayQueue) SortEntries() {
 	q.EntryMutex.Unlock()
 }
 
+// AddPending puts a song into the play queue before it is downloaded, so it
+// can be voted on and the downloads can follow the play order.
+func (q *PlayQueue) AddPending(e Entry) {
+	e.Pending = true
+	// The download queue holds a copy of e, votes go to this one only
+	votes := make(map[string]int, len(e.votedFor))
+	for k, v := range e.votedFor {
+		votes[k] = v
+	}
+	e.votedFor = votes
+	q.push(e)
+	q.SortEntries()
+}
+
+// MarkReady marks a pending entry as downloaded. It returns false if the
+// entry was deleted from the queue in the meantime.
+func (q *PlayQueue) MarkReady(e Entry) bool {
+	q.EntryMutex.Lock()
+	for i := range q.Entries {
+		if q.Entries[i].ID == e.ID {
+			q.Entries[i].Pending = false
+			q.Entries[i].Loudness = e.Loudness
+			ready := q.Entries[i]
+			select {
+			case q.wakeup() <- struct{}{}:
+			default:
+			}
+			q.EntryMutex.Unlock()
+			q.changed()
+			publishEntry(EventStageChanged, q.Stage, ready)
+			return true
+		}
+	}
+	q.EntryMutex.Unlock()
+	return false
+}
+
+// DropPending removes an entry whose download failed.
+func (q *PlayQueue) DropPending(id string) {
+	q.remove(id)
+}
+
+// Positions returns where the entries are in the play order.
+func (q *PlayQueue) Positions() map[string]int {
+	q.EntryMutex.Lock()
+	defer q.EntryMutex.Unlock()
+	positions := make(map[string]int, len(q.Entries))
+	for i, e := range q.Entries {
+		positions[e.ID] = i
+	}
+	return positions
+}
+
+// Wait blocks until there is an entry that is ready to be played.
+func (q *PlayQueue) Wait(ctx context.Context) bool {
+	return q.waitFor(ctx, q.hasReady)
+}
+
+// hasReady reports whether an entry is downloaded, the caller must hold
+// EntryMutex.
+func (q *PlayQueue) hasReady() bool {
+	for _, e := range q.Entries {
+		if !e.Pending {
+			return true
+		}
+	}
+	return false
+}
+
+// tryPopReady takes the first entry that is downloaded, pending entries in
+// front of it keep their place.
+func (q *PlayQueue) tryPopReady() (Entry, bool) {
+	q.EntryMutex.Lock()
+	for i, e := range q.Entries {
+		if !e.Pending {
+			q.Entries = append(q.Entries[:i], q.Entries[i+1:]...)
+			q.EntryMutex.Unlock()
+			q.changed()
+			return e, true
+		}
+	}
+	q.EntryMutex.Unlock()
+	return Entry{}, false
+}
+
+// AddTrack adds a song of the local library. It skips the prepare and
+// download stages, the file is already there.
+func (q *PlayQueue) AddTrack(t library.Track, user user.User) error {
+	e := Entry{
+		ID:       uuid.New().String(),
+		Name:     t.Name(),
+		Artist:   t.Artist,
+		Hash:     t.ID,
+		Path:     t.Path,
+		AddedBy:  user.Username,
+		AddedAt:  time.Now(),
+		votedFor: make(map[string]int),
+	}
+	ok, err := q.Admit(e, q.Stage)
+	if !ok {
+		return err
+	}
+	log.Println("Adding library song to play queue: " + e.Name)
+	q.push(e)
+	q.SortEntries()
+	publishEntry(EventEntryAdded, q.Stage, e)
+	return nil
+}
+
 func (q *PlayQueue) SkipSong() {
-	q.cancelFunc()
+	q.playerMutex.Lock()
+	cancel := q.cancelFunc
+	q.playerMutex.Unlock()
+	if cancel == nil {
+		return
+	}
+	publishEntry(EventSongSkipped, q.Stage, q.CurrentEntry())
+	cancel()
 }
 
-func (q *PlayQueue) PlayNext() error {
-	if len(q.Entries) == 0 {
-		return nil
+func (q *PlayQueue) Pause() error {
+	return q.setPaused(true)
+}
+
+func (q *PlayQueue) Resume() error {
+	return q.setPaused(false)
+}
+
+// setPaused holds or continues the current song at its position. The stream
+// stays in the speaker, it just plays silence while paused.
+func (q *PlayQueue) setPaused(paused bool) error {
+	q.playerMutex.Lock()
+	defer q.playerMutex.Unlock()
+	if q.current == nil {
+		return errors.New("no song playing")
+	}
+	speaker.Lock()
+	q.current.ctrl.Paused = paused
+	if q.handover != nil {
+		q.handover.track.ctrl.Paused = paused
 	}
+	speaker.Unlock()
+	q.SongInfo.Mutex.Lock()
+	q.SongInfo.Paused = paused
+	e := q.SongInfo.Entry
+	q.SongInfo.Mutex.Unlock()
+	if paused {
+		publishEntry(EventSongPaused, q.Stage, e)
+	} else {
+		publishEntry(EventSongResumed, q.Stage, e)
+	}
+	return nil
+}
 
-	log.Println("Trying to play next Song")
+func (q *PlayQueue) isPaused() bool {
+	q.SongInfo.Mutex.Lock()
+	defer q.SongInfo.Mutex.Unlock()
+	return q.SongInfo.Paused
+}
 
-	e := q.PopEntry()
+func (q *PlayQueue) Volume() int {
+	q.playerMutex.Lock()
+	defer q.playerMutex.Unlock()
+	return q.volume
+}
 
+// SetVolume sets the playback volume in percent. It applies to the current
+// song right away and to all following songs.
+func (q *PlayQueue) SetVolume(percent int) error {
+	if percent < 0 || percent > 100 {
+		return errors.New("volume must be between 0 and 100")
+	}
+	q.playerMutex.Lock()
+	q.volume = percent
+	speaker.Lock()
+	if q.current != nil {
+		q.current.setVolume(percent)
+	}
+	if q.handover != nil {
+		q.handover.track.setVolume(percent)
+	}
+	speaker.Unlock()
+	q.playerMutex.Unlock()
+	q.changed()
+	return nil
+}
+
+// Seek moves the current song to position. The seek is carried out by the
+// playback loop of the song.
+func (q *PlayQueue) Seek(position time.Duration) error {
+	q.playerMutex.Lock()
+	seeks := q.seeks
+	var done <-chan struct{}
+	if q.ctx != nil {
+		done = q.ctx.Done()
+	}
+	q.playerMutex.Unlock()
+	if seeks == nil {
+		return errors.New("no song playing")
+	}
+	req := seekRequest{position, make(chan error, 1)}
+	select {
+	case seeks <- req:
+	case <-done:
+		return errors.New("no song playing")
+	}
+	return <-req.result
+}
+
+// showSong makes e the song reported as currently playing.
+func (q *PlayQueue) showSong(e Entry) {
 	q.SongInfo.Mutex.Lock()
 	q.SongInfo.Entry = e
+	q.SongInfo.Position = 0
+	q.SongInfo.Length = 0
+	q.SongInfo.Paused = false
 	q.SongInfo.Mutex.Unlock()
+	if q.Cache != nil {
+		q.Cache.Played(e.Hash)
+	}
+	publishEntry(EventSongStarted, q.Stage, e)
+}
 
-	log.Println("Playing next Song " + e.Hash + " " + e.Name)
+// hideSong clears the song info, unless another song took over already.
+func (q *PlayQueue) hideSong(e Entry) {
+	q.SongInfo.Mutex.Lock()
+	defer q.SongInfo.Mutex.Unlock()
+	if q.SongInfo.ID != e.ID {
+		return
+	}
+	q.SongInfo.Entry = Entry{}
+	q.SongInfo.Position = 0
+	q.SongInfo.Length = 0
+	q.SongInfo.Paused = false
+}
+
+func (q *PlayQueue) updatePosition(t *track) {
+	position, length := t.position()
+	q.SongInfo.Mutex.Lock()
+	if q.SongInfo.ID != t.entry.ID {
+		q.SongInfo.Mutex.Unlock()
+		return
+	}
+	q.SongInfo.Position = position
+	q.SongInfo.Length = length
+	q.SongInfo.Mutex.Unlock()
+	Events.Publish(Event{Type: EventPosition, Stage: q.Stage, Entry: &t.entry, Position: position, Length: length})
+}
 
-	fp := filepath.Join(q.MusicDir, e.Hash) + ".mp3"
+// startHandover fades out t if it is about to end and another song is
+// ready to be played. The following call of PlayNext fades in the next song.
+func (q *PlayQueue) startHandover(t *track) bool {
+	if q.Crossfade <= 0 || q.isPaused() {
+		return false
+	}
+	q.EntryMutex.Lock()
+	ready := q.hasReady()
+	q.EntryMutex.Unlock()
+	if !ready {
+		return false
+	}
+	position, length := t.position()
+	remaining := length - position
+	if remaining > q.Crossfade {
+		return false
+	}
+	t.fade(false, remaining)
+	now := time.Now()
+	h := &handover{track: t, midpoint: now.Add(remaining / 2), end: now.Add(remaining)}
+	q.playerMutex.Lock()
+	q.handover = h
+	q.playerMutex.Unlock()
+	go q.finishHandover(h)
+	return true
+}
 
-	f, err := os.Open(fp)
-	if err != nil {
-		return errors.New("Error opening file: " + err.Error())
+// finishHandover writes the history of a fading track at the crossfade
+// midpoint and unloads it once it faded out.
+func (q *PlayQueue) finishHandover(h *handover) {
+	select {
+	case <-time.After(time.Until(h.midpoint)):
+	case <-h.track.ended:
 	}
-	defer f.Close()
+	e := h.track.entry
+	e.PlayedAt = time.Now()
+	WriteHistory(e, q.MusicDir)
+	log.Println("Song played: " + e.Name)
 
-	streamer, format, err := mp3.Decode(f)
+	select {
+	case <-h.track.ended:
+	case <-time.After(time.Until(h.end) + time.Second):
+	}
+	h.track.stop()
+	q.hideSong(e)
+	q.playerMutex.Lock()
+	if q.handover == h {
+		q.handover = nil
+	}
+	q.playerMutex.Unlock()
+}
+
+// PlayNext plays the next song until it ended or was skipped. With crossfade
+// enabled it returns as soon as the song started to fade out, so the next one
+// can fade in.
+func (q *PlayQueue) PlayNext(ctx context.Context) error {
+	e, ok := q.tryPopReady()
+	if !ok {
+		return nil
+	}
+
+	log.Println("Playing next Song " + e.Hash + " " + e.Name)
+
+	t, err := openTrack(e, q.MusicDir)
 	if err != nil {
-		return errors.New("Error decoding file: " + err.Error())
+		return err
 	}
-	defer streamer.Close()
 
-	resampled := beep.Resample(4, format.SampleRate, sampleRate, streamer)
-	q.ctx, q.cancelFunc = context.WithCancel(context.Background())
+	q.playerMutex.Lock()
+	q.ctx, q.cancelFunc = context.WithCancel(ctx)
 	defer q.cancelFunc()
-	speaker.Play(beep.Seq(resampled, beep.Callback(func() {
-		q.cancelFunc()
-	})))
+	if q.Normalize {
+		t.normalize(q.LoudnessTarget)
+	}
+	t.setVolume(q.volume)
+	q.current = t
+	q.seeks = make(chan seekRequest)
+	seeks := q.seeks
+	h := q.handover
+	q.playerMutex.Unlock()
+
+	// Switch over to this song at the midpoint of the crossfade
+	var switchOver <-chan time.Time
+	if h != nil && time.Now().Before(h.end) {
+		t.fade(true, time.Until(h.end))
+		switchOver = time.After(time.Until(h.midpoint))
+	} else {
+		q.showSong(e)
+	}
+	speaker.Play(t.ctrl)
 
 	// Start a ticker to display the current position
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				position := sampleRate.D(streamer.Position())
-				length := sampleRate.D(streamer.Len())
-				q.SongInfo.Mutex.Lock()
-				q.SongInfo.Position = position
-				q.SongInfo.Length = length
-				q.SongInfo.Mutex.Unlock()
-			case <-q.ctx.Done():
-				return
+	handedOver := false
+	for !handedOver {
+		select {
+		case <-ticker.C:
+			q.updatePosition(t)
+			handedOver = q.startHandover(t)
+		case req := <-seeks:
+			err := t.seek(req.position)
+			if err == nil {
+				q.updatePosition(t)
 			}
+			req.result <- err
+		case <-switchOver:
+			q.showSong(e)
+		case <-t.ended:
+			q.cancelFunc()
+		case <-q.ctx.Done():
 		}
-	}()
+		if q.ctx.Err() != nil {
+			break
+		}
+	}
 
-	<-q.ctx.Done()
+	q.playerMutex.Lock()
+	q.current = nil
+	q.seeks = nil
+	q.playerMutex.Unlock()
 
-	q.SongInfo.Mutex.Lock()
-	q.SongInfo.Entry = Entry{}
-	q.SongInfo.Position = 0
-	q.SongInfo.Length = 0
-	q.SongInfo.Mutex.Unlock()
+	if handedOver {
+		return nil
+	}
+
+	t.stop()
+
+	if ctx.Err() != nil {
+		q.EmptySongInfo()
+		q.requeue(e)
+		return ctx.Err()
+	}
+
+	q.hideSong(e)
 
 	e.PlayedAt = time.Now()
 	WriteHistory(e, q.MusicDir)
@@ -288,10 +716,19 @@ func (q *PlayQueue) VoteSong(id string, upvote bool, user user.User) error {
 	if !upvote {
 		amount = -1
 	}
+	err := q.vote(id, amount, user.Username)
+	if err != nil {
+		return err
+	}
+	q.SortEntries()
+	return nil
+}
+
+func (q *Queue) vote(id string, amount int, username string) error {
+	q.EntryMutex.Lock()
 	for i, e := range q.Entries {
 		if e.ID == id {
-			q.EntryMutex.Lock()
-			lastvote, ok := q.Entries[i].votedFor[user.Username]
+			lastvote, ok := q.Entries[i].votedFor[username]
 			if ok {
 				if lastvote == amount {
 					q.EntryMutex.Unlock()
@@ -299,26 +736,125 @@ func (q *PlayQueue) VoteSong(id string, upvote bool, user user.User) error {
 				}
 				q.Entries[i].Points -= lastvote
 			}
-			q.Entries[i].votedFor[user.Username] = amount
+			q.Entries[i].votedFor[username] = amount
 			q.Entries[i].Points += amount
+			voted := q.Entries[i]
 			q.EntryMutex.Unlock()
-			q.SortEntries()
+			q.changed()
+			publishEntry(EventVoteChanged, q.Stage, voted)
 			return nil
 		}
 	}
+	q.EntryMutex.Unlock()
 	return errors.New("song not found")
 }
 
+// MergeDuplicate looks for an entry with the same hash as e. If there is one,
+// e is dropped and counts as an upvote for it by the user who added e.
+func (q *Queue) MergeDuplicate(e Entry, from Stage) bool {
+	q.EntryMutex.Lock()
+	id := ""
+	for _, o := range q.Entries {
+		if o.Hash == e.Hash {
+			id = o.ID
+			break
+		}
+	}
+	q.EntryMutex.Unlock()
+	if id == "" {
+		return false
+	}
+	log.Println("Song " + e.Name + " is already queued, counting it as a vote")
+	err := q.vote(id, 1, e.AddedBy)
+	if err != nil {
+		log.Println("Not counting duplicate as vote: " + err.Error())
+	}
+	publishEntry(EventEntryDeleted, from, e)
+	return true
+}
+
+func (q *PlayQueue) MergeDuplicate(e Entry, from Stage) bool {
+	if !q.Queue.MergeDuplicate(e, from) {
+		return false
+	}
+	q.SortEntries()
+	return true
+}
+
+// Admit turns a song that is already queued into a vote for it and rejects
+// songs that were played too recently. It returns true if e should be
+// queued.
+func (q *PlayQueue) Admit(e Entry, from Stage) (bool, error) {
+	if q.MergeDuplicate(e, from) {
+		return false, nil
+	}
+	err := q.CheckCooldown(e)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CheckCooldown rejects songs that are playing or were played less than
+// Cooldown ago.
+func (q *PlayQueue) CheckCooldown(e Entry) error {
+	if q.Cooldown <= 0 {
+		return nil
+	}
+	if q.CurrentEntry().Hash == e.Hash {
+		return rejectedError("it is playing right now")
+	}
+	last, err := LastPlayed(q.MusicDir, e.Hash)
+	if err != nil {
+		return err
+	}
+	if wait := time.Until(last.Add(q.Cooldown)); wait > 0 {
+		return rejectedError(fmt.Sprintf("it was played at %v and can be played again in %v", last.Format("15:04"), wait.Round(time.Minute)))
+	}
+	return nil
+}
+
 func (q *Queue) DeleteSong(id string) error {
+	e, ok := q.remove(id)
+	if !ok {
+		return errors.New("song not found")
+	}
+	publishEntry(EventEntryDeleted, q.Stage, e)
+	return nil
+}
+
+// remove takes the entry with id out of the queue.
+func (q *Queue) remove(id string) (Entry, bool) {
+	q.EntryMutex.Lock()
 	for i, e := range q.Entries {
 		if e.ID == id {
-			q.EntryMutex.Lock()
 			q.Entries = append(q.Entries[:i], q.Entries[i+1:]...)
 			q.EntryMutex.Unlock()
-			return nil
+			q.changed()
+			return e, true
 		}
 	}
-	return errors.New("song not found")
+	q.EntryMutex.Unlock()
+	return Entry{}, false
+}
+
+// Cancel drops a song that was deleted from the play queue before it was
+// downloaded. The deletion was published by the play queue already.
+func (q *DownloadQueue) Cancel(id string) {
+	q.remove(id)
+}
+
+func (q *Queue) SetSongInfo(e Entry) {
+	q.SongInfo.Mutex.Lock()
+	q.SongInfo.Entry = e
+	q.SongInfo.Mutex.Unlock()
+	q.changed()
+}
+
+func (q *Queue) CurrentEntry() Entry {
+	q.SongInfo.Mutex.Lock()
+	defer q.SongInfo.Mutex.Unlock()
+	return q.SongInfo.Entry
 }
 
 func (q *Queue) EmptySongInfo() {
@@ -327,63 +863,162 @@ func (q *Queue) EmptySongInfo() {
 	q.SongInfo.Mutex.Unlock()
 }
 
-func fileExists(filename string) bool {
-	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		return false
+func (q *DownloadQueue) setActive(e Entry) {
+	q.activeMutex.Lock()
+	q.active = append(q.active, e)
+	q.activeMutex.Unlock()
+	q.changed()
+}
+
+func (q *DownloadQueue) removeActive(id string) {
+	q.activeMutex.Lock()
+	defer q.activeMutex.Unlock()
+	for i, e := range q.active {
+		if e.ID == id {
+			q.active = append(q.active[:i], q.active[i+1:]...)
+			return
+		}
 	}
-	// Return true only if it exists and is not a directory
-	return !info.IsDir()
 }
 
-func (q *DownloadQueue) DownloadNext() (Entry, error) {
-	if len(q.Entries) == 0 {
-		return Entry{}, nil
+// setProgress updates the progress of an active entry. It does not save the
+// state, progress is not kept over a restart.
+func (q *DownloadQueue) setProgress(id string, p downloader.Progress) {
+	q.activeMutex.Lock()
+	var e *Entry
+	for i := range q.active {
+		if q.active[i].ID == id {
+			e = &q.active[i]
+			break
+		}
+	}
+	if e == nil {
+		q.activeMutex.Unlock()
+		return
 	}
+	e.Progress = &p
+	ev := *e
+	q.activeMutex.Unlock()
+	publishEntry(EventDownloadProgress, q.Stage, ev)
+}
 
-	log.Println("Trying to download next Song")
+// GetActiveEntries returns the entries that are currently being downloaded.
+func (q *DownloadQueue) GetActiveEntries() []Entry {
+	q.activeMutex.Lock()
+	defer q.activeMutex.Unlock()
+	res := make([]Entry, len(q.active))
+	copy(res, q.active)
+	return res
+}
 
-	e := q.PopEntry()
+// popNext takes the entry that will be played first. Entries the play order
+// does not know keep their order behind those.
+func (q *DownloadQueue) popNext() (Entry, bool) {
+	var positions map[string]int
+	if q.Positions != nil {
+		positions = q.Positions()
+	}
+	q.EntryMutex.Lock()
+	if len(q.Entries) == 0 {
+		q.EntryMutex.Unlock()
+		return Entry{}, false
+	}
+	next := 0
+	best := -1
+	for i, e := range q.Entries {
+		if p, ok := positions[e.ID]; ok && (best < 0 || p < best) {
+			next, best = i, p
+		}
+	}
+	e := q.Entries[next]
+	q.Entries = append(q.Entries[:next], q.Entries[next+1:]...)
+	q.EntryMutex.Unlock()
+	q.changed()
+	return e, true
+}
 
-	q.SongInfo.Mutex.Lock()
-	q.SongInfo.Entry = e
-	q.SongInfo.Mutex.Unlock()
+// DownloadNext downloads the next entry of the queue. It is safe to call from
+// several workers at once.
+func (q *DownloadQueue) DownloadNext(ctx context.Context) (Entry, error) {
+	e, ok := q.popNext()
+	if !ok {
+		return Entry{}, nil
+	}
+
+	q.setActive(e)
 
 	log.Println("Downloading next Song " + e.Hash)
 
-	fp := filepath.Join(q.MusicDir, e.Hash) + ".mp3"
-	if !fileExists(fp) {
-		log.Println("Downloading to " + fp)
-		err := downloader.Download(e.URL, e.Hash, q.MusicDir)
+	fp, ok := q.Cache.Lookup(e.Hash)
+	if !ok {
+		log.Println("Downloading " + e.URL)
+		var err error
+		var reported time.Time
+		progress := func(p downloader.Progress) {
+			// yt-dlp reports many times a second, the listeners do not need all
+			if p.Percent < 100 && time.Since(reported) < progressInterval {
+				return
+			}
+			reported = time.Now()
+			q.setProgress(e.ID, p)
+		}
+		fp, err = downloader.Download(ctx, e.URL, e.Hash, q.MusicDir, q.AudioFormat, e.Start, e.End, progress)
+		if ctx.Err() != nil {
+			q.removeActive(e.ID)
+			q.requeue(e)
+			return e, ctx.Err()
+		}
 		if err != nil {
-			q.EmptySongInfo()
+			q.removeActive(e.ID)
 			return e, errors.New("Error downloading file: " + err.Error())
 		}
+		err = q.Cache.Add(cache.Item{Hash: e.Hash, Title: e.Name, URL: e.URL, Duration: e.Duration}, fp)
+		if err != nil {
+			log.Println(err)
+		}
 	} else {
 		log.Println("File already exists")
+		if e.Loudness == 0 {
+			e.Loudness = q.Cache.Loudness(e.Hash)
+		}
 	}
 
-	q.EmptySongInfo()
+	// Measure here, so playback never waits for the analysis
+	if q.AnalyzeLoudness && e.Loudness == 0 {
+		loudness, err := downloader.Loudness(ctx, fp)
+		if err != nil {
+			log.Println("Error analysing loudness of " + e.Hash + ": " + err.Error())
+		} else {
+			e.Loudness = loudness
+			err = q.Cache.SetLoudness(e.Hash, loudness)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	q.removeActive(e.ID)
 
 	return e, nil
 }
 
-func (q *PrepareQueue) AddEntry(input string, user user.User) error {
+func (q *PrepareQueue) AddEntry(input string, start time.Duration, end time.Duration, user user.User) error {
 	var e Entry
 	e.votedFor = make(map[string]int)
 	e.AddedBy = user.Username
 	e.AddedAt = time.Now()
 	e.Points = 0
 	e.Name = input
+	e.Start = start
+	e.End = end
 	e.ID = uuid.New().String()
 	log.Println("Adding song to prepare queue: " + e.Name)
-	q.EntryMutex.Lock()
-	q.Entries = append(q.Entries, e)
-	q.EntryMutex.Unlock()
+	q.push(e)
+	publishEntry(EventEntryAdded, q.Stage, e)
 	return nil
 }
 
-func (q *PrepareQueue) PrepareNext() (Entry, error) {
+func (q *PrepareQueue) PrepareNext(ctx context.Context) (Entry, error) {
 	if len(q.Entries) == 0 {
 		return Entry{}, nil
 	}
@@ -392,48 +1027,116 @@ func (q *PrepareQueue) PrepareNext() (Entry, error) {
 
 	e := q.PopEntry()
 
-	q.SongInfo.Mutex.Lock()
-	q.SongInfo.Entry = e
-	q.SongInfo.Mutex.Unlock()
+	q.SetSongInfo(e)
 
 	log.Println("Preparing next Song " + e.Name)
 	input := e.Name
 	if isValidUrl(input) {
 		e.URL = input
-		cmd := exec.Command("yt-dlp", "--print", "title", input)
-
-		// Capture the output
-		var out bytes.Buffer
-		cmd.Stdout = &out
-		err := cmd.Run()
-		if err != nil {
-			fmt.Printf("Error running yt-dlp: %v\n", err)
+	} else {
+		result, err := Search(ctx, q.Providers, input, 1)
+		if ctx.Err() != nil {
 			q.EmptySongInfo()
-			return Entry{}, errors.New("Error running yt-dlp: " + err.Error())
+			q.requeue(e)
+			return e, ctx.Err()
 		}
-		e.Name = strings.TrimSpace(string(out.String()))
-	} else {
-		result, err := searchYouTube(input, 1, q.APIKey)
 		if err != nil {
 			log.Println("Error searching for song: " + err.Error())
 			q.EmptySongInfo()
-			return Entry{}, errors.New("Error searching for song: " + err.Error())
+			return e, fmt.Errorf("Error searching for song: %w", err)
 		}
 
 		if len(result) == 0 {
 			q.EmptySongInfo()
-			return Entry{}, errors.New("no results found")
+			return e, permanentError("no results found")
+		}
+
+		e.Name = result[0].Title
+		e.URL = result[0].URL
+	}
+
+	info, err := downloader.FetchInfo(ctx, e.URL)
+	if ctx.Err() != nil {
+		q.EmptySongInfo()
+		q.requeue(e)
+		return e, ctx.Err()
+	}
+	if err != nil {
+		log.Println(err)
+		q.EmptySongInfo()
+		return e, err
+	}
+	if info.IsPlaylist() {
+		q.EmptySongInfo()
+		if len(info.Entries) == 0 {
+			return e, permanentError("playlist is empty")
 		}
+		q.expandPlaylist(e, info.Entries)
+		// The playlist itself has no hash, it is not downloaded
+		return e, nil
+	}
+	if info.Title != "" {
+		e.Name = info.Title
+	}
+	e.Duration = info.Length()
+	e.Artist = info.ArtistName()
+	e.Channel = info.Channel
+	if e.Channel == "" {
+		e.Channel = info.Uploader
+	}
+	e.Thumbnail = info.Thumbnail
+	e.VideoID = info.ID
+	e.Extractor = info.Extractor
+	err = clip(&e)
+	if err != nil {
+		q.EmptySongInfo()
+		return e, err
+	}
 
-		e.Name = html.UnescapeString(result[0]["title"])
-		e.URL = result[0]["url"]
+	err = q.Policy.Check(e)
+	if err != nil {
+		log.Println("Song " + e.Name + " " + err.Error())
+		q.EmptySongInfo()
+		return e, err
 	}
 	log.Println("Sing prepared: " + e.Name + " (" + e.URL + ")")
-	h := sha1.New()
-	h.Write([]byte(e.URL))
-	e.Hash = hex.EncodeToString(h.Sum(nil))
+	e.Hash = hashEntry(e)
 	q.EmptySongInfo()
 
 	return e, nil
 
 }
+
+// expandPlaylist puts one entry per track of a playlist in front of the
+// queue, in playlist order and attributed to the user who added the playlist.
+func (q *PrepareQueue) expandPlaylist(e Entry, tracks []downloader.PlaylistEntry) {
+	if q.PlaylistLimit > 0 && len(tracks) > q.PlaylistLimit {
+		log.Printf("Playlist %v has %v tracks, only adding %v", e.Name, len(tracks), q.PlaylistLimit)
+		tracks = tracks[:q.PlaylistLimit]
+	}
+	entries := []Entry{}
+	for _, t := range tracks {
+		if t.URL == "" {
+			continue
+		}
+		// Adding the playlist already paid for the first track
+		if len(entries) > 0 && q.Charge != nil && !q.Charge(e.AddedBy) {
+			log.Printf("%v can not pay for more tracks of playlist %v", e.AddedBy, e.Name)
+			break
+		}
+		n := Entry{
+			ID:      uuid.New().String(),
+			Name:    t.URL,
+			AddedBy: e.AddedBy,
+			// Keeps the playlist order when the play queue is sorted
+			AddedAt:  e.AddedAt.Add(time.Duration(len(entries))),
+			votedFor: make(map[string]int),
+		}
+		entries = append(entries, n)
+	}
+	log.Printf("Expanded playlist %v into %v songs", e.Name, len(entries))
+	q.pushFront(entries...)
+	for _, n := range entries {
+		publishEntry(EventEntryAdded, q.Stage, n)
+	}
+}
@@ -0,0 +1,73 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type fakeProvider struct {
+	name    string
+	results []SearchResult
+	err     error
+	calls   int
+}
+
+func (p *fakeProvider) Name() string {
+	return p.name
+}
+
+func (p *fakeProvider) Search(ctx context.Context, query string, maxResults int) ([]SearchResult, error) {
+	p.calls++
+	return p.results, p.err
+}
+
+func TestSearchTakesFirstProviderWithResults(t *testing.T) {
+	failing := &fakeProvider{name: "failing", err: errors.New("timeout")}
+	empty := &fakeProvider{name: "empty"}
+	found := &fakeProvider{name: "found", results: []SearchResult{{Title: "Wandadoog"}}}
+	unused := &fakeProvider{name: "unused", results: []SearchResult{{Title: "Other"}}}
+
+	results, err := Search(context.Background(), []SearchProvider{failing, empty, found, unused}, "wandadoog", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 || results[0].Title != "Wandadoog" {
+		t.Fatalf("got results %v", results)
+	}
+	if failing.calls != 1 || empty.calls != 1 || found.calls != 1 {
+		t.Errorf("providers before the hit were not all asked once")
+	}
+	if unused.calls != 0 {
+		t.Errorf("provider after the hit was asked")
+	}
+}
+
+func TestSearchErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []error
+		permanent bool
+	}{
+		{"no results", []error{nil, nil}, true},
+		{"all permanent", []error{permanentError("no key"), permanentError("no results")}, true},
+		{"one retryable", []error{permanentError("no key"), errors.New("timeout")}, false},
+		{"all retryable", []error{errors.New("timeout"), errors.New("quota")}, false},
+		{"retryable and empty", []error{errors.New("timeout"), nil}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			providers := []SearchProvider{}
+			for _, err := range tt.errs {
+				providers = append(providers, &fakeProvider{name: "fake", err: err})
+			}
+			_, err := Search(context.Background(), providers, "query", 1)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if IsPermanent(err) != tt.permanent {
+				t.Errorf("IsPermanent(%v) = %v, want %v", err, IsPermanent(err), tt.permanent)
+			}
+		})
+	}
+}
@@ -21,6 +21,13 @@ const formatTime = (nanoseconds: number): string => {
     return `${minutes}:${remainingSeconds.toString().padStart(2, "0")}`;
   };
 
+const formatSpeed = (bytesPerSecond: number): string => {
+    if (bytesPerSecond >= 1024 * 1024) {
+      return `${(bytesPerSecond / 1024 / 1024).toFixed(1)} MiB/s`;
+    }
+    return `${(bytesPerSecond / 1024).toFixed(0)} KiB/s`;
+  };
+
 const QueueItem: React.FC<QueueItemProps> = ({ song, itemType, onUpvote, onDownvote, onDelete, onSkip, mode, userIsModerator }) => {
   const modeIsVoting = mode !== Mode.Simple;
   const canSkipAndDelete = mode === Mode.Simple || mode === Mode.Voting || userIsModerator;
@@ -47,6 +54,16 @@ const QueueItem: React.FC<QueueItemProps> = ({ song, itemType, onUpvote, onDownv
             )}
             </div>
         )}
+        {itemType == QueueItemType.DOWNLOAD && song.progress && (
+            <div className="mt2 flex flex-col space-y-2">
+            <progress value={song.progress.percent} max={100} className="w-full" />
+            <p className="text-center text-sm text-gray-100">
+                {song.progress.percent.toFixed(0)}%
+                {song.progress.speed > 0 && ` · ${formatSpeed(song.progress.speed)}`}
+                {song.progress.eta > 0 && ` · ${formatTime(song.progress.eta)} left`}
+            </p>
+            </div>
+        )}
         {itemType == QueueItemType.QUEUE && (
             <div className="mt2 flex flex-col space-y-2">
              { modeIsVoting && (
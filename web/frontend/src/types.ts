@@ -10,8 +10,15 @@ export interface Song {
 	points:     number
     position:  number
     length:     number   
+    progress?:  DownloadProgress
   }
 
+export interface DownloadProgress {
+    percent: number;
+    speed:   number;
+    eta:     number;
+}
+
 export interface QueueResponse {
     preparequeue: Song[];
     downloadqueue: Song[];